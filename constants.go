@@ -17,6 +17,7 @@ const (
 	typeFloat      = 'f'
 	typeArray      = '['
 	typeHash       = '{'
+	typeHashDef    = '}'
 	typeSymbol     = ':'
 	typeSymlink    = ';'
 	typeString     = '"'
@@ -24,11 +25,15 @@ const (
 	typeIvar       = 'I'
 	typeClass      = 'c'
 	typeModule     = 'm'
+	typeOldModule  = 'M'
 	typeObject     = 'o'
 	typeLink       = '@'
 	typeUsrMarshal = 'U'
 	typeUsrDef     = 'u'
 	typeStruct     = 'S'
+	typeExtended   = 'e'
+	typeUsrClass   = 'C'
+	typeData       = 'd'
 )
 
 // Modifier flags for Ruby regular expressions
@@ -40,6 +45,14 @@ const (
 	RegexpNoEncoding    = 1 << 5
 )
 
+// Names of the Ruby string encodings that get special treatment in the Marshal format.
+// Any other encoding is referred to by its Ruby name (e.g "Shift_JIS").
+const (
+	EncodingUTF8   = "UTF-8"
+	EncodingASCII  = "US-ASCII"
+	EncodingBinary = "ASCII-8BIT"
+)
+
 const (
 	// The highest+lowest values that can be encoded in a fixnum
 	fixnumMin = -0x40000000
@@ -49,6 +62,13 @@ const (
 	fixnumMaxBytes = 5
 )
 
+const (
+	// Legacy Marshal streams store extra mantissa bits after the decimal representation of a float.
+	// These are the values Ruby uses for IEEE754 doubles.
+	floatDecimalMant = 53 - 16
+	floatMantBits    = 32
+)
+
 // Ripped from math/big since we deal with the raw Words ourselves
 const (
 	_m    = ^big.Word(0)
@@ -1,11 +1,13 @@
 package rmarsh
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"math"
 	"math/big"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -21,11 +23,20 @@ var ErrGeneratorOverflow = fmt.Errorf("Write past end of bounded array/hash/ivar
 // be the next value. This expectation is enforced when writing the keys of an ivar, struct and object.
 var ErrNonSymbolValue = fmt.Errorf("Non Symbol value written when Symbol expected")
 
+// ErrGeneratorUnfinished is the error returned when a Generator is reset before the Marshal stream it was writing was
+// finished, or after a failed write left the stream incomplete. The unfinished stream is discarded regardless.
+var ErrGeneratorUnfinished = fmt.Errorf("Reset of unfinished Marshal stream")
+
 const (
-	genStateGrowSize = 8 // Initial size + amount to grow state stack by
-	symTblGrowSize   = 8
+	genStateGrowSize = 8       // Initial size + amount to grow state stack by
+	symTblMaxSz      = 1 << 16 // Symbol table is discarded on Reset if it grows past this many entries
 )
 
+// UnknownLength can be passed to StartArray, StartHash and StartHashWithDefault when the number of elements is not
+// known in advance. The Generator counts the elements as they're written and fills in the length once the container
+// is ended.
+const UnknownLength = -1
+
 // Generator is a low-level streaming implementation of the Ruby Marshal 4.8 format.
 type Generator struct {
 	w  io.Writer
@@ -34,17 +45,37 @@ type Generator struct {
 
 	buf  []byte
 	bufn int
+	off  int // Offset in buf the stream started at.
 
+	app bool   // Set if the stream is being appended to a caller provided slice instead of written to w.
+	own []byte // Our own buffer, stashed while buf is a caller provided slice.
+
+	// Symbols are kept in the table across Resets, so that a reused Generator doesn't need to allocate for them again.
+	// Only the entries marked with the current epoch have been written in the current stream.
+	symTbl   map[string]*genSym
 	symCount int
-	symTbl   []string
+	symEpoch int
+	syms     []*genSym // The symbols written in the current stream, indexed by symlink id.
+
+	lnkCount int // Number of linkable objects written so far.
+
+	flushAt int // Buffered data is written out once it reaches this size, 0 if only done when the stream is finished.
+
+	strict bool // Set if names are validated, see SetStrict.
+
+	err error // Set once the stream has been left incomplete by a failed write, returned by every call until Reset.
+
+	encTbl map[string]int // Link ids of the encoding names written so far.
 }
 
 // NewGenerator returns a new Generator that is ready to start writing out a Ruby Marshal stream. Generators are not
 // thread safe, but can be reused for new Marshal streams by calling Reset().
 func NewGenerator(w io.Writer) *Generator {
 	gen := &Generator{
-		w:   w,
-		buf: make([]byte, 128),
+		w:      w,
+		buf:    make([]byte, 128),
+		symTbl: make(map[string]*genSym),
+		encTbl: make(map[string]int),
 	}
 	gen.st.stack = make([]genStateItem, genStateGrowSize)
 	gen.Reset(nil)
@@ -54,19 +85,142 @@ func NewGenerator(w io.Writer) *Generator {
 // Reset restores the state of the Generator to an identity state, ready to write a new Marshal stream.
 // If provided io.Writer is nil, the existing writer is used.
 // Reusing Generators is encouraged, to recycle the internal structures that are allocated during generation.
-func (gen *Generator) Reset(w io.Writer) {
+// If the previous Marshal stream was left unfinished, whatever of it was still buffered is discarded and
+// ErrGeneratorUnfinished is returned. The Generator is reset either way.
+func (gen *Generator) Reset(w io.Writer) error {
+	err := gen.checkFinished()
 	if w != nil {
 		gen.w = w
 	}
+	if gen.app {
+		gen.buf, gen.own, gen.app = gen.own, nil, false
+	}
+	gen.reset(0)
+	return err
+}
+
+// ResetAppend restores the state of the Generator to an identity state, ready to write a new Marshal stream that is
+// appended to dst instead of being written to the io.Writer. Once the stream is finished, it can be retrieved with
+// Bytes(). If dst has enough spare capacity for the stream, the Generator does not allocate.
+// Call Reset to go back to writing to the io.Writer.
+// Like Reset, ErrGeneratorUnfinished is returned if the previous Marshal stream was left unfinished.
+func (gen *Generator) ResetAppend(dst []byte) error {
+	err := gen.checkFinished()
+	if !gen.app {
+		gen.own, gen.app = gen.buf, true
+	}
+	if cap(dst)-len(dst) < len(magic) {
+		dst = append(dst, magic...)[:len(dst)]
+	}
+	gen.buf = dst[:cap(dst)]
+	gen.reset(len(dst))
+	return err
+}
+
+// Returns ErrGeneratorUnfinished if a value has been started but the stream isn't finished yet, or if it was left
+// incomplete by a failed write.
+func (gen *Generator) checkFinished() error {
+	if gen.st.sz > 1 || gen.err != nil {
+		return ErrGeneratorUnfinished
+	}
+	return nil
+}
+
+// Bytes returns the slice passed to ResetAppend with the Marshal stream appended to it.
+// Returns nil if the Generator is not appending to a slice.
+func (gen *Generator) Bytes() []byte {
+	if !gen.app {
+		return nil
+	}
+	return gen.buf[:gen.bufn]
+}
 
+// Resets the generation state, and starts the new Marshal stream at the given offset in the buffer.
+func (gen *Generator) reset(off int) {
 	gen.st.reset()
 
 	gen.c = 0
+	gen.err = nil
 	gen.symCount = 0
+	gen.symEpoch++
+	gen.syms = gen.syms[:0]
+	// Don't let the symbol table grow without bounds if the Generator is writing lots of distinct symbols.
+	if len(gen.symTbl) > symTblMaxSz {
+		gen.symTbl = make(map[string]*genSym)
+	}
+	gen.lnkCount = 0
+	for k := range gen.encTbl {
+		delete(gen.encTbl, k)
+	}
+
+	gen.buf[off] = 0x04
+	gen.buf[off+1] = 0x08
+	gen.off = off
+	gen.bufn = off + 2
+}
+
+// Len returns the number of bytes of the Marshal stream generated so far, including those still buffered.
+func (gen *Generator) Len() int {
+	return gen.c + gen.bufn - gen.off
+}
+
+// Done returns true once the top level value of the Marshal stream has been completely written.
+func (gen *Generator) Done() bool {
+	return gen.st.sz == 1 && gen.st.cur.pos == gen.st.cur.cnt
+}
+
+// GenPathItem describes one of the arrays, hashes, etc that enclose the next value written by a Generator.
+// Pos and Len count values the same way the Generator does: the keys and values of hashes, objects and structs are
+// counted separately, and the main value of an IVar is at position -1, before its instance var names and values.
+// A hash with a default value has Kind TokenStartHash, and its default value is counted after its keys and values.
+type GenPathItem struct {
+	Kind Token // The token a Parser emits at the start of this kind of value, e.g TokenStartArray.
+	Pos  int   // The position of the next value written.
+	Len  int   // The number of values to be written, or UnknownLength.
+}
+
+var genStTokens = [...]Token{
+	genStArr:      TokenStartArray,
+	genStHash:     TokenStartHash,
+	genStHashDef:  TokenStartHash,
+	genStIVar:     TokenStartIVar,
+	genStObj:      TokenStartObject,
+	genStUsrMarsh: TokenUsrMarshal,
+	genStStruct:   TokenStartStruct,
+	genStExtended: TokenExtended,
+	genStUsrClass: TokenUsrClass,
+	genStData:     TokenData,
+}
+
+// Depth returns the number of arrays, hashes, etc that are currently being written.
+func (gen *Generator) Depth() int {
+	return gen.st.sz - 1
+}
 
-	gen.buf[0] = 0x04
-	gen.buf[1] = 0x08
-	gen.bufn = 2
+// Path returns the arrays, hashes, etc that are currently being written, outermost first.
+func (gen *Generator) Path() []GenPathItem {
+	path := make([]GenPathItem, 0, gen.st.sz-1)
+	for i := 1; i < gen.st.sz; i++ {
+		st := &gen.st.stack[i]
+		path = append(path, GenPathItem{Kind: genStTokens[st.typ], Pos: st.pos, Len: st.cnt})
+	}
+	return path
+}
+
+// SetFlushThreshold sets the number of bytes the Generator buffers before writing them to the underlying io.Writer.
+// By default nothing is written until the top level value is finished, so large streams are held entirely in memory.
+// Setting a threshold keeps memory use bounded, at the cost of more writes. A threshold of 0 restores the default.
+func (gen *Generator) SetFlushThreshold(n int) {
+	gen.flushAt = n
+}
+
+// SetStrict enables or disables strict mode. In strict mode, the Generator rejects values that Ruby would fail to load:
+// class and module names that aren't valid constant paths (such as Foo::Bar), instance var names on objects and IVars
+// that aren't prefixed with '@', struct member names that are, and encoding instance vars ("E" and "encoding") on
+// values that don't have an encoding. The contents of fragments written with Raw aren't checked.
+// Strict mode is disabled by default.
+func (gen *Generator) SetStrict(strict bool) {
+	gen.strict = strict
 }
 
 // Nil writes the nil value to the Marshal stream.
@@ -149,6 +303,7 @@ func (gen *Generator) Bignum(b *big.Int) error {
 
 	gen.buf[gen.bufn] = typeBignum
 	gen.bufn++
+	gen.lnkCount++
 	if b.Sign() < 0 {
 		gen.buf[gen.bufn] = '-'
 	} else {
@@ -183,30 +338,61 @@ func (gen *Generator) Bignum(b *big.Int) error {
 // Writes given symbol (or a symlink if symbol already written before) but does not check state or advance write state.
 // Intended to be used where symbols are embedded in other value types (like StartObject)
 func (gen *Generator) writeSym(sym string) {
-	if l := len(gen.symTbl); l == 0 || l == gen.symCount {
-		newTbl := make([]string, l+symTblGrowSize)
-		copy(newTbl, gen.symTbl)
-		gen.symTbl = newTbl
+	s, ok := gen.symTbl[sym]
+	if ok && s.epoch == gen.symEpoch {
+		gen.writeSymlink(s.id)
+		return
 	}
 
-	for i := 0; i < gen.symCount; i++ {
-		if gen.symTbl[i] == sym {
-			gen.buf[gen.bufn] = typeSymlink
-			gen.bufn++
-			gen.encodeLong(int64(i))
-			return
-		}
+	gen.buf[gen.bufn] = typeSymbol
+	gen.bufn++
+	gen.writeString(sym)
+
+	if !ok {
+		s = new(genSym)
+		gen.symTbl[sym] = s
+	}
+	gen.addSym(s)
+}
+
+// Like writeSym, but for a symbol in a byte slice. The symbol table needs its own copy of the symbol, so the first
+// time a Generator writes each symbol it allocates.
+func (gen *Generator) writeSymBytes(sym []byte) {
+	s, ok := gen.symTbl[string(sym)]
+	if ok && s.epoch == gen.symEpoch {
+		gen.writeSymlink(s.id)
+		return
 	}
 
-	l := len(sym)
 	gen.buf[gen.bufn] = typeSymbol
 	gen.bufn++
-	gen.encodeLong(int64(l))
-	copy(gen.buf[gen.bufn:], sym)
-	gen.bufn += l
+	gen.writeBytes(sym)
+
+	if !ok {
+		s = new(genSym)
+		gen.symTbl[string(sym)] = s
+	}
+	gen.addSym(s)
+}
 
-	gen.symTbl[gen.symCount] = sym
+func (gen *Generator) addSym(s *genSym) {
+	s.id, s.epoch = gen.symCount, gen.symEpoch
 	gen.symCount++
+	gen.syms = append(gen.syms, s)
+}
+
+func (gen *Generator) writeSymlink(id int) {
+	gen.buf[gen.bufn] = typeSymlink
+	gen.bufn++
+	gen.encodeLong(int64(id))
+}
+
+// Returns the symlink id of given symbol, or -1 if it hasn't been written yet.
+func (gen *Generator) findSym(sym string) int {
+	if s, ok := gen.symTbl[sym]; ok && s.epoch == gen.symEpoch {
+		return s.id
+	}
+	return -1
 }
 
 // Symbol writes a Ruby symbol value to the Marshal stream.
@@ -216,12 +402,35 @@ func (gen *Generator) Symbol(sym string) error {
 	if err := gen.checkState(true, 1+fixnumMaxBytes+len(sym)); err != nil {
 		return err
 	}
+	if gen.strict {
+		if err := gen.checkName(sym); err != nil {
+			return err
+		}
+	}
+	gen.markEnc()
 
 	gen.writeSym(sym)
 
 	return gen.writeAdv()
 }
 
+// SymbolBytes is the same as Symbol, but takes the symbol name as a byte slice.
+func (gen *Generator) SymbolBytes(sym []byte) error {
+	if err := gen.checkState(true, 1+fixnumMaxBytes+len(sym)); err != nil {
+		return err
+	}
+	if gen.strict {
+		if err := gen.checkName(string(sym)); err != nil {
+			return err
+		}
+	}
+	gen.markEnc()
+
+	gen.writeSymBytes(sym)
+
+	return gen.writeAdv()
+}
+
 // Writes given string to stream but does not check state or advance it.
 func (gen *Generator) writeString(str string) {
 	l := len(str)
@@ -230,21 +439,181 @@ func (gen *Generator) writeString(str string) {
 	gen.bufn += l
 }
 
+// Writes given bytes as a string to stream but does not check state or advance it.
+func (gen *Generator) writeBytes(b []byte) {
+	l := len(b)
+	gen.encodeLong(int64(l))
+	copy(gen.buf[gen.bufn:], b)
+	gen.bufn += l
+}
+
 // String writes the given string to the Marshal stream.
-// Be sure to call StartIVar first if you need to include encoding information.
+// Be sure to call StartIVar first if you need to include encoding information, or use StringEnc.
 func (gen *Generator) String(str string) error {
 	l := len(str)
 	if err := gen.checkState(false, 1+fixnumMaxBytes+l); err != nil {
 		return err
 	}
 
+	gen.markEnc()
 	gen.buf[gen.bufn] = typeString
 	gen.bufn++
+	gen.lnkCount++
 	gen.writeString(str)
 
 	return gen.writeAdv()
 }
 
+// StringBytes is the same as String, but takes the string as a byte slice.
+func (gen *Generator) StringBytes(str []byte) error {
+	l := len(str)
+	if err := gen.checkState(false, 1+fixnumMaxBytes+l); err != nil {
+		return err
+	}
+
+	gen.markEnc()
+	gen.buf[gen.bufn] = typeString
+	gen.bufn++
+	gen.lnkCount++
+	gen.writeBytes(str)
+
+	return gen.writeAdv()
+}
+
+// StringFrom writes a string of length n, read from r, to the Marshal stream.
+// Unlike String, the contents are copied directly from r to the underlying io.Writer instead of being buffered, which
+// makes it suitable for very large strings. Any data that is still buffered is written out first.
+// StringFrom cannot be used inside an array or hash started with UnknownLength, since their contents must stay
+// buffered until the length is known.
+// If r can't provide n bytes, or writing to the io.Writer fails, the Marshal stream is left incomplete. The Generator
+// then returns the same error from every call until it is Reset.
+func (gen *Generator) StringFrom(r io.Reader, n int64) error {
+	if err := gen.checkState(false, 1+fixnumMaxBytes); err != nil {
+		return err
+	}
+	if err := gen.checkStream("StringFrom", n); err != nil {
+		return err
+	}
+
+	gen.markEnc()
+	gen.buf[gen.bufn] = typeString
+	gen.bufn++
+	gen.lnkCount++
+	gen.encodeLong(n)
+
+	if err := gen.copyFrom(r, n); err != nil {
+		return err
+	}
+	return gen.writeAdv()
+}
+
+// Checks that a value of length n can be streamed directly to the underlying io.Writer.
+func (gen *Generator) checkStream(fn string, n int64) error {
+	if n < 0 || n > math.MaxInt32 {
+		return errors.Errorf("%s() called with invalid length %d", fn, n)
+	}
+	for i := 0; i < gen.st.sz; i++ {
+		if gen.st.stack[i].cnt == UnknownLength {
+			return errors.Errorf("%s() called inside of context of array or hash with unknown length", fn)
+		}
+	}
+	return nil
+}
+
+// Flushes the buffer and then copies n bytes from r directly to the underlying io.Writer.
+// The header of the value has already been written, so if the copy fails the stream can't be completed.
+func (gen *Generator) copyFrom(r io.Reader, n int64) error {
+	var err error
+	if gen.app {
+		// There's no io.Writer to copy to, so we read into the buffer instead.
+		// Leave room for the ivar count that may follow the value.
+		gen.grow(int(n) + fixnumMaxBytes)
+		var c int
+		c, err = io.ReadFull(r, gen.buf[gen.bufn:gen.bufn+int(n)])
+		gen.bufn += c
+	} else if err = gen.flush(); err == nil {
+		var c int64
+		c, err = io.CopyN(gen.w, r, n)
+		gen.c += int(c)
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		gen.err = err
+	}
+	return err
+}
+
+// StringEnc writes the given string along with its Ruby encoding to the Marshal stream.
+// UTF-8 and US-ASCII strings are written with the short "E" instance var, ASCII-8BIT strings have no encoding
+// information, and any other encoding is written with an "encoding" instance var, exactly as Ruby does.
+func (gen *Generator) StringEnc(str, enc string) error {
+	if enc == EncodingBinary {
+		return gen.String(str)
+	}
+	if err := gen.StartIVar(1); err != nil {
+		return err
+	}
+	if err := gen.String(str); err != nil {
+		return err
+	}
+	if err := gen.encoding(enc); err != nil {
+		return err
+	}
+	return gen.EndIVar()
+}
+
+// SymbolEnc writes a Ruby symbol value with the given encoding to the Marshal stream.
+// Like Ruby, encoding information is only written for symbols that contain non ASCII characters, and is omitted
+// when the symbol has already been written and is referred to by a symlink.
+func (gen *Generator) SymbolEnc(sym, enc string) error {
+	if enc == EncodingBinary || isASCII(sym) || gen.findSym(sym) > -1 {
+		return gen.Symbol(sym)
+	}
+	if err := gen.StartIVar(1); err != nil {
+		return err
+	}
+	if err := gen.Symbol(sym); err != nil {
+		return err
+	}
+	if err := gen.encoding(enc); err != nil {
+		return err
+	}
+	return gen.EndIVar()
+}
+
+// Writes the instance var pair that describes given encoding in the current IVar context.
+// Ruby dumps the name of non special encodings as a String, which is linked if the encoding is used again.
+func (gen *Generator) encoding(enc string) error {
+	switch enc {
+	case EncodingUTF8, EncodingASCII:
+		if err := gen.Symbol("E"); err != nil {
+			return err
+		}
+		return gen.Bool(enc == EncodingUTF8)
+	}
+
+	if err := gen.Symbol("encoding"); err != nil {
+		return err
+	}
+	if id, ok := gen.encTbl[enc]; ok {
+		return gen.Link(id)
+	}
+	gen.encTbl[enc] = gen.lnkCount
+	return gen.String(enc)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
 // Float writes the given float value to the Marshal stream.
 func (gen *Generator) Float(f float64) error {
 	// String repr of a float64 will never exceed 30 chars.
@@ -255,11 +624,25 @@ func (gen *Generator) Float(f float64) error {
 
 	gen.buf[gen.bufn] = typeFloat
 	gen.bufn++
+	gen.lnkCount++
 
 	// We pass a 0 len slice of our scratch buffer to append float.
 	// This ensures it makes no allocation since the append() calls it makes
 	// will just consume existing capacity.
-	b := strconv.AppendFloat(gen.buf[gen.bufn+1:gen.bufn+1:len(gen.buf)], f, 'g', -1, 64)
+	dst := gen.buf[gen.bufn+1 : gen.bufn+1 : len(gen.buf)]
+
+	// Ruby has its own names for the special float values. Negative zero is already written as "-0".
+	var b []byte
+	switch {
+	case math.IsInf(f, 1):
+		b = append(dst, "inf"...)
+	case math.IsInf(f, -1):
+		b = append(dst, "-inf"...)
+	case math.IsNaN(f):
+		b = append(dst, "nan"...)
+	default:
+		b = strconv.AppendFloat(dst, f, 'g', -1, 64)
+	}
 	l := len(b)
 
 	gen.encodeLong(int64(l))
@@ -270,24 +653,33 @@ func (gen *Generator) Float(f float64) error {
 
 // StartArray begins writing an array to the Marshal stream.
 // When all elements are written, EndArray() must be called.
+// If l is UnknownLength, any number of elements may be written and the length is filled in by EndArray().
 func (gen *Generator) StartArray(l int) error {
 	if err := gen.checkState(false, 1+fixnumMaxBytes); err != nil {
 		return err
 	}
 	gen.buf[gen.bufn] = typeArray
 	gen.bufn++
+	gen.lnkCount++
+	lenAt := gen.bufn
 	gen.encodeLong(int64(l))
 
 	gen.st.push(genStArr, l)
+	gen.st.cur.lenAt = lenAt
 	return nil
 }
 
 // EndArray completes the array currently being generated.
 func (gen *Generator) EndArray() error {
+	if gen.err != nil {
+		return gen.err
+	}
 	if gen.st.sz == 0 || gen.st.cur.typ != genStArr {
 		return errors.New("EndArray() called outside of context of array")
 	}
-	if gen.st.cur.pos != gen.st.cur.cnt {
+	if gen.st.cur.cnt == UnknownLength {
+		gen.patchLen(gen.st.cur.pos)
+	} else if gen.st.cur.pos != gen.st.cur.cnt {
 		return errors.Errorf("EndArray() called prematurely, %d of %d elems written", gen.st.cur.pos, gen.st.cur.cnt)
 	}
 	gen.st.pop()
@@ -297,24 +689,60 @@ func (gen *Generator) EndArray() error {
 
 // StartHash behins writing a hash to the Marshal stream.
 // When all elements are written, EndHash() must be called.
+// If l is UnknownLength, any number of pairs may be written and the length is filled in by EndHash().
 func (gen *Generator) StartHash(l int) error {
+	return gen.startHash(typeHash, genStHash, l)
+}
+
+// StartHashWithDefault begins writing a hash that has a default value to the Marshal stream.
+// After the l pairs of elements have been written, the default value must be written, and then EndHash() called.
+// If l is UnknownLength, any number of pairs may be written, and the last value written before EndHash() is the
+// default value.
+func (gen *Generator) StartHashWithDefault(l int) error {
+	return gen.startHash(typeHashDef, genStHashDef, l)
+}
+
+func (gen *Generator) startHash(typ byte, st uint8, l int) error {
 	if err := gen.checkState(false, 1+fixnumMaxBytes); err != nil {
 		return err
 	}
-	gen.buf[gen.bufn] = typeHash
+	gen.buf[gen.bufn] = typ
 	gen.bufn++
+	gen.lnkCount++
+	lenAt := gen.bufn
 	gen.encodeLong(int64(l))
 
-	gen.st.push(genStHash, l*2)
+	cnt := UnknownLength
+	if l != UnknownLength {
+		cnt = l * 2
+		if st == genStHashDef {
+			cnt++
+		}
+	}
+	gen.st.push(st, cnt)
+	gen.st.cur.lenAt = lenAt
 	return nil
 }
 
 // EndHash completes the hash currently being generated.
 func (gen *Generator) EndHash() error {
-	if gen.st.sz == 0 || gen.st.cur.typ != genStHash {
+	if gen.err != nil {
+		return gen.err
+	}
+	if gen.st.sz == 0 || (gen.st.cur.typ != genStHash && gen.st.cur.typ != genStHashDef) {
 		return errors.New("EndHash() called outside of context of hash")
 	}
-	if gen.st.cur.pos != gen.st.cur.cnt {
+	if gen.st.cur.cnt == UnknownLength {
+		// The default value follows the pairs, so we expect an odd number of elems for hashes that have one.
+		pos := gen.st.cur.pos
+		if gen.st.cur.typ == genStHashDef {
+			pos--
+		}
+		if pos < 0 || pos&1 == 1 {
+			return errors.Errorf("EndHash() called prematurely, %d elems written", gen.st.cur.pos)
+		}
+		gen.patchLen(pos / 2)
+	} else if gen.st.cur.pos != gen.st.cur.cnt {
 		return errors.Errorf("EndHash() called prematurely, %d of %d elems written", gen.st.cur.pos, gen.st.cur.cnt)
 	}
 	gen.st.pop()
@@ -325,12 +753,16 @@ func (gen *Generator) EndHash() error {
 // Class writes a Ruby class reference to the Marshal stream.
 func (gen *Generator) Class(name string) error {
 	l := len(name)
+	if err := gen.checkConst("Class", name); err != nil {
+		return err
+	}
 	if err := gen.checkState(false, 1+fixnumMaxBytes+l); err != nil {
 		return err
 	}
 
 	gen.buf[gen.bufn] = typeClass
 	gen.bufn++
+	gen.lnkCount++
 	gen.encodeLong(int64(l))
 	copy(gen.buf[gen.bufn:], name)
 	gen.bufn += l
@@ -341,12 +773,16 @@ func (gen *Generator) Class(name string) error {
 // Module writes a Ruby module reference to the Marshal stream.
 func (gen *Generator) Module(name string) error {
 	l := len(name)
+	if err := gen.checkConst("Module", name); err != nil {
+		return err
+	}
 	if err := gen.checkState(false, 1+fixnumMaxBytes+l); err != nil {
 		return err
 	}
 
 	gen.buf[gen.bufn] = typeModule
 	gen.bufn++
+	gen.lnkCount++
 	gen.encodeLong(int64(l))
 	copy(gen.buf[gen.bufn:], name)
 	gen.bufn += l
@@ -374,12 +810,18 @@ func (gen *Generator) StartIVar(l int) error {
 
 // EndIVar completes the ivar currently being generated.
 func (gen *Generator) EndIVar() error {
+	if gen.err != nil {
+		return gen.err
+	}
 	if gen.st.sz == 0 || gen.st.cur.typ != genStIVar {
 		return errors.New("EndIVar() called outside of context of ivar")
 	}
 	if gen.st.cur.pos != gen.st.cur.cnt {
 		return errors.Errorf("EndIVar() called prematurely, %d of %d elems written", gen.st.cur.pos, gen.st.cur.cnt)
 	}
+	if gen.st.cur.lnkDefer {
+		gen.lnkCount++
+	}
 	gen.st.pop()
 
 	return gen.writeAdv()
@@ -388,6 +830,9 @@ func (gen *Generator) EndIVar() error {
 // StartObject begins writing an object with provided class name to the Marshal stream.
 // The next calls must be l pairs of Symbol+<any> calls.
 func (gen *Generator) StartObject(name string, l int) error {
+	if err := gen.checkConst("StartObject", name); err != nil {
+		return err
+	}
 	// Need enough space for the two type bytes (object + symbol), the encoded length of the symbol, and the encoded
 	// length of the object variables.
 	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(name)+fixnumMaxBytes); err != nil {
@@ -395,6 +840,7 @@ func (gen *Generator) StartObject(name string, l int) error {
 	}
 	gen.buf[gen.bufn] = typeObject
 	gen.bufn++
+	gen.lnkCount++
 
 	gen.writeSym(name)
 
@@ -406,6 +852,9 @@ func (gen *Generator) StartObject(name string, l int) error {
 
 // EndObject completes the object currently being generated.
 func (gen *Generator) EndObject() error {
+	if gen.err != nil {
+		return gen.err
+	}
 	if gen.st.sz == 0 || gen.st.cur.typ != genStObj {
 		return errors.New("EndObject() called outside of context of object")
 	}
@@ -422,11 +871,15 @@ func (gen *Generator) EndObject() error {
 // The next call can be any value type.
 // UserMarshalled object state must be completed with a call to EndUserMarshalled().
 func (gen *Generator) StartUserMarshalled(name string) error {
+	if err := gen.checkConst("StartUserMarshalled", name); err != nil {
+		return err
+	}
 	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(name)); err != nil {
 		return err
 	}
 	gen.buf[gen.bufn] = typeUsrMarshal
 	gen.bufn++
+	gen.lnkCount++
 
 	gen.writeSym(name)
 
@@ -436,6 +889,9 @@ func (gen *Generator) StartUserMarshalled(name string) error {
 
 // EndUserMarshalled completes the user marshalled object currently being written.
 func (gen *Generator) EndUserMarshalled() error {
+	if gen.err != nil {
+		return gen.err
+	}
 	if gen.st.sz == 0 || gen.st.cur.typ != genStUsrMarsh {
 		return errors.New("EndUserMarshalled() called outside of context of user marshaalled object")
 	}
@@ -447,35 +903,126 @@ func (gen *Generator) EndUserMarshalled() error {
 	return gen.writeAdv()
 }
 
+// StartData begins writing a typed data object with provided class name to the Marshal stream.
+// Typed data objects are Ruby objects implemented in C extensions that have a _load_data function.
+// The next call can be any value type, it will be passed to _load_data.
+// Data object state must be completed with a call to EndData().
+func (gen *Generator) StartData(name string) error {
+	if err := gen.checkConst("StartData", name); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(name)); err != nil {
+		return err
+	}
+	gen.buf[gen.bufn] = typeData
+	gen.bufn++
+	gen.lnkCount++
+
+	gen.writeSym(name)
+
+	gen.st.push(genStData, 1)
+	return nil
+}
+
+// EndData completes the typed data object currently being written.
+func (gen *Generator) EndData() error {
+	if gen.err != nil {
+		return gen.err
+	}
+	if gen.st.sz == 0 || gen.st.cur.typ != genStData {
+		return errors.New("EndData() called outside of context of data object")
+	}
+	if gen.st.cur.pos != gen.st.cur.cnt {
+		return errors.Errorf("EndData() called prematurely, data value not yet written")
+	}
+	gen.st.pop()
+
+	return gen.writeAdv()
+}
+
 // UserDefinedObject writes a user defined object with the given name and data string to the Marshal stream.
 // User defined objects are Ruby objects that have a _load function that accepts a string and construct the object.
 // If you need to specify encoding on the data string, open an IVar context with StartIVar before calling this method.
 func (gen *Generator) UserDefinedObject(name, data string) error {
+	if err := gen.checkConst("UserDefinedObject", name); err != nil {
+		return err
+	}
 	if err := gen.checkState(false, 1+fixnumMaxBytes+len(name)+fixnumMaxBytes+len(data)); err != nil {
 		return err
 	}
-	gen.buf[gen.bufn] = typeUsrDef
-	gen.bufn++
+	gen.writeUsrDef(name, int64(len(data)))
+	copy(gen.buf[gen.bufn:], data)
+	gen.bufn += len(data)
 
-	gen.writeSym(name)
+	return gen.writeAdv()
+}
 
-	gen.encodeLong(int64(len(data)))
+// UserDefinedObjectBytes is the same as UserDefinedObject, but takes the data string as a byte slice.
+func (gen *Generator) UserDefinedObjectBytes(name string, data []byte) error {
+	if err := gen.checkConst("UserDefinedObjectBytes", name); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+fixnumMaxBytes+len(name)+fixnumMaxBytes+len(data)); err != nil {
+		return err
+	}
+	gen.writeUsrDef(name, int64(len(data)))
 	copy(gen.buf[gen.bufn:], data)
 	gen.bufn += len(data)
 
 	return gen.writeAdv()
 }
 
+// UserDefinedObjectFrom writes a user defined object with the given name to the Marshal stream. The data string of
+// length n is copied directly from r to the underlying io.Writer, in the same way as StringFrom. Failures leave the
+// Generator in the same error state as they do for StringFrom.
+func (gen *Generator) UserDefinedObjectFrom(name string, r io.Reader, n int64) error {
+	if err := gen.checkConst("UserDefinedObjectFrom", name); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+fixnumMaxBytes+len(name)+fixnumMaxBytes); err != nil {
+		return err
+	}
+	if err := gen.checkStream("UserDefinedObjectFrom", n); err != nil {
+		return err
+	}
+	gen.writeUsrDef(name, n)
+
+	if err := gen.copyFrom(r, n); err != nil {
+		return err
+	}
+	return gen.writeAdv()
+}
+
+// Writes the header of a user defined object, up to and including the length of its data.
+func (gen *Generator) writeUsrDef(name string, n int64) {
+	gen.buf[gen.bufn] = typeUsrDef
+	gen.bufn++
+
+	// Ruby registers user defined objects as linkable *after* any instance vars on the data string have been
+	// written, so if we're the value of an IVar we defer until that's done.
+	gen.markEnc()
+	if gen.st.cur.typ == genStIVar && gen.st.cur.pos == -1 {
+		gen.st.cur.lnkDefer = true
+	} else {
+		gen.lnkCount++
+	}
+
+	gen.writeSym(name)
+	gen.encodeLong(n)
+}
+
 // Regexp writes regular expression with given text + flags to the Marshal stream.
 // Look at REGEXP_* flags for valid ones.
-// To set encoding on the regexp obj, wrap it in an IVar.
+// To set encoding on the regexp obj, wrap it in an IVar or use RegexpEnc.
 func (gen *Generator) Regexp(expr string, flags byte) error {
 	if err := gen.checkState(false, 1+fixnumMaxBytes+len(expr)+1); err != nil {
 		return err
 	}
 
+	gen.markEnc()
 	gen.buf[gen.bufn] = typeRegExp
 	gen.bufn++
+	gen.lnkCount++
 	gen.writeString(expr)
 	gen.buf[gen.bufn] = flags
 	gen.bufn++
@@ -483,14 +1030,125 @@ func (gen *Generator) Regexp(expr string, flags byte) error {
 	return gen.writeAdv()
 }
 
+// RegexpBytes is the same as Regexp, but takes the regular expression text as a byte slice.
+func (gen *Generator) RegexpBytes(expr []byte, flags byte) error {
+	if err := gen.checkState(false, 1+fixnumMaxBytes+len(expr)+1); err != nil {
+		return err
+	}
+
+	gen.markEnc()
+	gen.buf[gen.bufn] = typeRegExp
+	gen.bufn++
+	gen.lnkCount++
+	gen.writeBytes(expr)
+	gen.buf[gen.bufn] = flags
+	gen.bufn++
+
+	return gen.writeAdv()
+}
+
+// RegexpEnc writes regular expression with given text + flags + encoding to the Marshal stream.
+// The encoding is written the same way as StringEnc does.
+func (gen *Generator) RegexpEnc(expr string, flags byte, enc string) error {
+	if enc == EncodingBinary {
+		return gen.Regexp(expr, flags)
+	}
+	if err := gen.StartIVar(1); err != nil {
+		return err
+	}
+	if err := gen.Regexp(expr, flags); err != nil {
+		return err
+	}
+	if err := gen.encoding(enc); err != nil {
+		return err
+	}
+	return gen.EndIVar()
+}
+
+// StartExtended begins writing an object that has been extended with the given module to the Marshal stream.
+// The next call must write the extended object, and then EndExtended() must be called.
+// Objects extended with multiple modules can be written by nesting calls to StartExtended.
+func (gen *Generator) StartExtended(module string) error {
+	if err := gen.checkConst("StartExtended", module); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(module)); err != nil {
+		return err
+	}
+	gen.buf[gen.bufn] = typeExtended
+	gen.bufn++
+
+	gen.writeSym(module)
+
+	gen.st.push(genStExtended, 1)
+	return nil
+}
+
+// EndExtended completes the extended object currently being written.
+func (gen *Generator) EndExtended() error {
+	if gen.err != nil {
+		return gen.err
+	}
+	if gen.st.sz == 0 || gen.st.cur.typ != genStExtended {
+		return errors.New("EndExtended() called outside of context of extended object")
+	}
+	if gen.st.cur.pos != gen.st.cur.cnt {
+		return errors.Errorf("EndExtended() called prematurely, extended object not yet written")
+	}
+	gen.st.pop()
+
+	return gen.writeAdv()
+}
+
+// StartUserClass begins writing an instance of a user defined subclass of String, Array, Hash or Regexp with the
+// provided class name to the Marshal stream.
+// The next call must write the underlying String/Array/Hash/Regexp value, and then EndUserClass() must be called.
+// If the value has instance variables (such as string encoding), open an IVar context with StartIVar before calling
+// this method.
+func (gen *Generator) StartUserClass(name string) error {
+	if err := gen.checkConst("StartUserClass", name); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(name)); err != nil {
+		return err
+	}
+	gen.buf[gen.bufn] = typeUsrClass
+	gen.bufn++
+
+	gen.writeSym(name)
+
+	gen.st.push(genStUsrClass, 1)
+	return nil
+}
+
+// EndUserClass completes the user class value currently being written.
+func (gen *Generator) EndUserClass() error {
+	if gen.err != nil {
+		return gen.err
+	}
+	if gen.st.sz == 0 || gen.st.cur.typ != genStUsrClass {
+		return errors.New("EndUserClass() called outside of context of user class")
+	}
+	if gen.st.cur.pos != gen.st.cur.cnt {
+		return errors.Errorf("EndUserClass() called prematurely, wrapped value not yet written")
+	}
+	gen.st.pop()
+
+	return gen.writeAdv()
+}
+
 // StartStruct begins writing a struct value to the Marshal stream.
 // l pairs of Symbol + values must be written after this call, and then punctuated with a call to EndStruct
 func (gen *Generator) StartStruct(name string, l int) error {
+	if err := gen.checkConst("StartStruct", name); err != nil {
+		return err
+	}
 	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(name)+fixnumMaxBytes); err != nil {
 		return err
 	}
 	gen.buf[gen.bufn] = typeStruct
 	gen.bufn++
+	gen.lnkCount++
 
 	gen.writeSym(name)
 
@@ -502,6 +1160,9 @@ func (gen *Generator) StartStruct(name string, l int) error {
 
 // EndStruct completes the struct currently being generated.
 func (gen *Generator) EndStruct() error {
+	if gen.err != nil {
+		return gen.err
+	}
 	if gen.st.sz == 0 || gen.st.cur.typ != genStStruct {
 		return errors.New("EndStruct() called outside of context of struct")
 	}
@@ -513,7 +1174,395 @@ func (gen *Generator) EndStruct() error {
 	return gen.writeAdv()
 }
 
+// NextLinkID returns the link id that will be assigned to the next linkable value written to the Marshal stream.
+// Linkable values are everything other than nil, true, false, Fixnums, Symbols and Links. Note that a user defined
+// object written as the value of an IVar is assigned its id after the instance vars have been written.
+func (gen *Generator) NextLinkID() int {
+	return gen.lnkCount
+}
+
+// Link writes a reference to a previously written linkable value to the Marshal stream.
+// The id may refer to a value that is still being written (such as an enclosing array), which is how cyclic object
+// graphs are expressed.
+func (gen *Generator) Link(id int) error {
+	if id < 0 || id >= gen.lnkCount {
+		return errors.Errorf("Link id %d not valid, %d linkable values written", id, gen.lnkCount)
+	}
+	if err := gen.checkState(false, 1+fixnumMaxBytes); err != nil {
+		return err
+	}
+
+	gen.buf[gen.bufn] = typeLink
+	gen.bufn++
+	gen.encodeLong(int64(id))
+
+	return gen.writeAdv()
+}
+
+// Checkpoint records the position of a Generator in its Marshal stream, so that the values written after it can be
+// discarded with Rollback.
+type Checkpoint struct {
+	epoch    int
+	c        int
+	pos      int
+	st       []genStateItem
+	symCount int
+	lnkCount int
+}
+
+// Checkpoint returns the current position in the Marshal stream. If writing the next value fails partway through, for
+// example because the data it is being generated from turns out to be invalid, Rollback can be used to return to this
+// position so that something else (such as nil) can be written in its place.
+func (gen *Generator) Checkpoint() Checkpoint {
+	return Checkpoint{
+		epoch:    gen.symEpoch,
+		c:        gen.c,
+		pos:      gen.c + gen.bufn,
+		st:       append([]genStateItem(nil), gen.st.stack[:gen.st.sz]...),
+		symCount: gen.symCount,
+		lnkCount: gen.lnkCount,
+	}
+}
+
+// Rollback discards everything written since the given Checkpoint was taken.
+// It's not possible to roll back once the data written after the Checkpoint has been flushed to the io.Writer, or once
+// the array, hash, etc the Checkpoint was taken in has been ended.
+func (gen *Generator) Rollback(cp Checkpoint) error {
+	if gen.err != nil {
+		return gen.err
+	}
+	if cp.epoch != gen.symEpoch {
+		return errors.New("Rollback() called with Checkpoint from another Marshal stream")
+	}
+	if cp.pos < gen.c {
+		return errors.Errorf("Rollback() not possible, %d bytes past Checkpoint already flushed", gen.c-cp.pos)
+	}
+	if gen.st.sz < len(cp.st) {
+		return errors.New("Rollback() called after context of Checkpoint was ended")
+	}
+	for i := 1; i < len(cp.st); i++ {
+		if gen.st.stack[i].id != cp.st[i].id {
+			return errors.New("Rollback() called after context of Checkpoint was ended")
+		}
+	}
+
+	gen.st.sz = copy(gen.st.stack, cp.st)
+	gen.st.cur = &gen.st.stack[gen.st.sz-1]
+	// The buffer may have been flushed up to the Checkpoint since it was taken.
+	for i := 0; i < gen.st.sz; i++ {
+		if gen.st.stack[i].cnt == UnknownLength {
+			gen.st.stack[i].lenAt -= gen.c - cp.c
+		}
+	}
+	gen.bufn = cp.pos - gen.c
+
+	for _, s := range gen.syms[cp.symCount:] {
+		s.epoch = 0
+	}
+	gen.syms = gen.syms[:cp.symCount]
+	gen.symCount = cp.symCount
+
+	for enc, id := range gen.encTbl {
+		if id >= cp.lnkCount {
+			delete(gen.encTbl, enc)
+		}
+	}
+	gen.lnkCount = cp.lnkCount
+
+	return nil
+}
+
+// Raw writes a pre-encoded value to the Marshal stream. The fragment must be a complete Marshal stream containing
+// a single value, such as one produced by another Generator.
+// The symlinks and links in the fragment are numbered relative to the fragment, so they are rewritten against this
+// stream as the fragment is copied. Symbols in the fragment that have already been written to this stream are
+// replaced with symlinks.
+func (gen *Generator) Raw(fragment []byte) error {
+	if len(fragment) < len(magic)+1 || !bytes.Equal(fragment[:len(magic)], magic) {
+		return errors.New("Raw() called with invalid fragment, expected a Marshal 4.8 stream")
+	}
+
+	// Parse the fragment first. That validates it before we write anything, and gives us its symbol table and the
+	// number of linkable values it contains.
+	p := NewParser(bytes.NewReader(fragment))
+	for {
+		tok, _, _, err := p.Read()
+		if err != nil {
+			return errors.Wrap(err, "Raw() called with invalid fragment")
+		}
+		if tok == TokenEOF {
+			break
+		}
+	}
+	if p.pos != len(fragment) {
+		return errors.Errorf("Raw() called with invalid fragment, %d trailing bytes", len(fragment)-p.pos)
+	}
+
+	typ := p.buf[len(magic)]
+	if err := gen.checkState(typ == typeSymbol || typ == typeSymlink, 0); err != nil {
+		return err
+	}
+	if typ == typeSymbol && gen.strict {
+		if err := gen.checkName(string(p.buf[p.symTbl[0].beg:p.symTbl[0].end])); err != nil {
+			return err
+		}
+	}
+	// Look through any extended objects and user classes at the top of the fragment, the encoding belongs to the value
+	// they wrap.
+	pos := len(magic)
+	for p.buf[pos] == typeExtended || p.buf[pos] == typeUsrClass {
+		_, sz, _, _, _ := p.decodeSym(pos + 1)
+		pos += 1 + sz
+	}
+	switch p.buf[pos] {
+	case typeSymbol, typeString, typeRegExp, typeUsrDef:
+		gen.markEnc()
+	}
+
+	raw := rawFragment{gen: gen, p: p, base: gen.lnkCount}
+	raw.value(len(magic))
+
+	// Like UserDefinedObject, a user defined object that is the value of an IVar is assigned its link id once the
+	// IVar is finished.
+	lnks := len(p.lnkTbl)
+	if typ == typeUsrDef && gen.st.cur.typ == genStIVar && gen.st.cur.pos == -1 {
+		gen.st.cur.lnkDefer = true
+		lnks--
+	}
+	gen.lnkCount += lnks
+
+	return gen.writeAdv()
+}
+
+// Ensures there's room for n more bytes in the buffer.
+// The buffer at least doubles in size each time it grows, so that generating a large stream takes linear time.
+func (gen *Generator) grow(n int) {
+	if len(gen.buf) >= gen.bufn+n {
+		return
+	}
+	sz := 2 * len(gen.buf)
+	if sz < gen.bufn+n {
+		sz = gen.bufn + n
+	}
+	newBuf := make([]byte, sz)
+	copy(newBuf, gen.buf[:gen.bufn])
+	gen.buf = newBuf
+}
+
+// rawFragment copies a fragment of Marshal data that has already been validated by Parser p into a Generator,
+// rewriting symlinks and links as it goes.
+type rawFragment struct {
+	gen  *Generator
+	p    *Parser
+	base int // link id of the first linkable value in the fragment
+}
+
+// Copies the value at pos in the fragment and returns the position after it.
+func (raw *rawFragment) value(pos int) int {
+	gen, buf := raw.gen, raw.p.buf
+	typ := buf[pos]
+
+	switch typ {
+	case typeSymbol, typeSymlink:
+		return raw.sym(pos)
+	case typeLink:
+		id, sz, _ := raw.p.decodeLong(pos + 1)
+		gen.grow(1 + fixnumMaxBytes)
+		gen.buf[gen.bufn] = typeLink
+		gen.bufn++
+		gen.encodeLong(int64(raw.base + id))
+		return pos + 1 + sz
+	}
+
+	// Everything else starts with its type byte and is copied as is, apart from any values nested inside of it.
+	start := pos
+	pos++
+
+	var n int
+	switch typ {
+	case typeFixnum, typeArray, typeHash, typeHashDef:
+		var sz int
+		n, sz, _ = raw.p.decodeLong(pos)
+		pos += sz
+	case typeFloat, typeString, typeClass, typeModule, typeOldModule:
+		pos = raw.blob(pos)
+	case typeRegExp:
+		pos = raw.blob(pos) + 1
+	case typeBignum:
+		l, sz, _ := raw.p.decodeLong(pos + 1)
+		pos += 1 + sz + l*2
+	case typeIvar, typeObject, typeStruct, typeUsrDef, typeUsrMarshal, typeData, typeExtended, typeUsrClass:
+		// These are followed by a value or a class/module name, which must be rewritten.
+		raw.copy(start, pos)
+		if typ == typeIvar {
+			pos = raw.value(pos)
+		} else {
+			pos = raw.sym(pos)
+		}
+
+		switch typ {
+		case typeIvar, typeObject, typeStruct:
+			// Then some number of pairs of symbols and values.
+			var sz int
+			n, sz, _ = raw.p.decodeLong(pos)
+			pos = raw.copy(pos, pos+sz)
+			for i := 0; i < n; i++ {
+				pos = raw.sym(pos)
+				pos = raw.value(pos)
+			}
+			return pos
+		case typeUsrDef:
+			return raw.copy(pos, raw.blob(pos))
+		default:
+			return raw.value(pos)
+		}
+	}
+	raw.copy(start, pos)
+
+	switch typ {
+	case typeHash:
+		n *= 2
+	case typeHashDef:
+		n = n*2 + 1
+	case typeArray:
+	default:
+		return pos
+	}
+	for i := 0; i < n; i++ {
+		pos = raw.value(pos)
+	}
+	return pos
+}
+
+// Copies the symbol or symlink at pos in the fragment and returns the position after it.
+func (raw *rawFragment) sym(pos int) int {
+	r, sz, _, _, _ := raw.p.decodeSym(pos)
+	sym := raw.p.buf[r.beg:r.end]
+	raw.gen.grow(1 + fixnumMaxBytes + len(sym))
+	raw.gen.writeSymBytes(sym)
+	return pos + sz
+}
+
+// Returns the position after the length prefixed blob at pos in the fragment.
+func (raw *rawFragment) blob(pos int) int {
+	l, sz, _ := raw.p.decodeLong(pos)
+	return pos + sz + l
+}
+
+// Copies the given range of the fragment as is, and returns the end of the range.
+func (raw *rawFragment) copy(beg, end int) int {
+	raw.gen.grow(end - beg)
+	raw.gen.bufn += copy(raw.gen.buf[raw.gen.bufn:], raw.p.buf[beg:end])
+	return end
+}
+
+// Fills in the length of the current container, which was started with UnknownLength.
+// The placeholder is a single byte, so if the real length needs more than that the container's content is shifted along.
+func (gen *Generator) patchLen(l int) {
+	end := gen.bufn
+	gen.grow(fixnumMaxBytes * 2)
+
+	// Encode the length past the end of the buffer, then move it into place.
+	var enc [fixnumMaxBytes]byte
+	gen.encodeLong(int64(l))
+	sz := copy(enc[:], gen.buf[end:gen.bufn])
+
+	at := gen.st.cur.lenAt
+	copy(gen.buf[at+sz:], gen.buf[at+1:end])
+	copy(gen.buf[at:], enc[:sz])
+	gen.bufn = end + sz - 1
+}
+
+// Marks the value of the current IVar as one that has an encoding, if that's what is being written.
+// Extended objects and user classes are looked through, since the encoding belongs to the value they wrap.
+func (gen *Generator) markEnc() {
+	for i := gen.st.sz - 1; i > 0; i-- {
+		st := &gen.st.stack[i]
+		switch {
+		case st.typ == genStIVar && st.pos == -1:
+			st.encOK = true
+			return
+		case (st.typ == genStExtended || st.typ == genStUsrClass) && st.pos == 0:
+		default:
+			return
+		}
+	}
+}
+
+// In strict mode, checks that name is a valid Ruby class or module name.
+func (gen *Generator) checkConst(fn, name string) error {
+	if gen.strict && !isConstPath(name) {
+		return errors.Errorf("%s() called with invalid constant name %q", fn, name)
+	}
+	return nil
+}
+
+// Checks that a symbol written as the name of an instance var or struct member is valid.
+func (gen *Generator) checkName(sym string) error {
+	cur := gen.st.cur
+	if cur.pos < 0 || cur.pos&1 == 1 {
+		return nil
+	}
+	switch cur.typ {
+	case genStObj:
+		if !isIVarName(sym) {
+			return errors.Errorf("Invalid instance var name %q written to object", sym)
+		}
+	case genStIVar:
+		if sym == "E" || sym == "encoding" {
+			if !cur.encOK {
+				return errors.Errorf("Encoding instance var %q written to IVar of value that has no encoding", sym)
+			}
+		} else if !isIVarName(sym) {
+			return errors.Errorf("Invalid instance var name %q written to IVar", sym)
+		}
+	case genStStruct:
+		if len(sym) > 0 && sym[0] == '@' {
+			return errors.Errorf("Invalid struct member name %q", sym)
+		}
+	}
+	return nil
+}
+
+// Returns true if name is a Ruby constant path, like Foo or Foo::Bar.
+func isConstPath(name string) bool {
+	for {
+		seg := name
+		i := strings.Index(name, "::")
+		if i >= 0 {
+			seg = name[:i]
+		}
+		if len(seg) == 0 || seg[0] < 'A' || seg[0] > 'Z' || !isIdent(seg[1:]) {
+			return false
+		}
+		if i < 0 {
+			return true
+		}
+		name = name[i+2:]
+	}
+}
+
+// Returns true if name is a Ruby instance var name, like @foo.
+func isIVarName(name string) bool {
+	return len(name) > 1 && name[0] == '@' && (name[1] < '0' || name[1] > '9') && isIdent(name[1:])
+}
+
+// Returns true if s only contains characters that can follow the first character of a Ruby identifier.
+func isIdent(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c < 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
 func (gen *Generator) checkState(isSym bool, sz int) error {
+	if gen.err != nil {
+		return gen.err
+	}
+
 	// Make sure we're not writing past bounds.
 	if gen.st.cur.pos == gen.st.cur.cnt {
 		if gen.st.sz == 1 {
@@ -535,13 +1584,7 @@ func (gen *Generator) checkState(isSym bool, sz int) error {
 		}
 	}
 
-	if len(gen.buf) < gen.bufn+sz {
-		newBuf := make([]byte, gen.bufn+sz)
-		if gen.bufn > 0 {
-			copy(newBuf, gen.buf)
-		}
-		gen.buf = newBuf
-	}
+	gen.grow(sz)
 
 	return nil
 }
@@ -553,19 +1596,69 @@ func (gen *Generator) writeAdv() error {
 	if gen.st.cur.typ == genStIVar && gen.st.cur.pos == 0 {
 		// If we just reached pos 0 for the current ivar, it means we wrote the main value and we're about to start
 		// on the instnace vars themselves. We need to write out the instance var count now.
+		// If the main value was a nested structure (like a user class), the space for the count may not have been
+		// reserved, so make sure we have it.
+		gen.grow(fixnumMaxBytes)
 		gen.encodeLong(int64(gen.st.cur.cnt / 2))
 	}
 
 	// If we've just finished writing out the last value, then we make sure to flush anything remaining.
-	// Otherwise, we let things accumulate in our small buffer between calls to reduce the number of writes.
+	// Otherwise, we let things accumulate in our small buffer between calls to reduce the number of writes, unless
+	// the flush threshold has been reached.
 	if gen.bufn > 0 && gen.st.cur.pos == gen.st.cur.cnt && gen.st.sz == 1 {
-		if _, err := gen.w.Write(gen.buf[:gen.bufn]); err != nil {
-			return err
+		return gen.flush()
+	}
+	if gen.flushAt > 0 && gen.bufn >= gen.flushAt {
+		return gen.flush()
+	}
+
+	return nil
+}
+
+// Flush writes all buffered data to the underlying io.Writer.
+// The contents of arrays and hashes started with UnknownLength are held back until their length is known.
+// If the write fails the Marshal stream is left incomplete, and the Generator returns the same error from every call
+// until it is Reset.
+func (gen *Generator) Flush() error {
+	return gen.flush()
+}
+
+func (gen *Generator) flush() error {
+	if gen.err != nil {
+		return gen.err
+	}
+	// When appending to a slice, the whole stream stays where it is.
+	if gen.app {
+		return nil
+	}
+
+	n := gen.bufn
+	// Everything from the length of the outermost unknown length array/hash onwards must stay in the buffer so that
+	// the length can be patched.
+	for i := 0; i < gen.st.sz; i++ {
+		if gen.st.stack[i].cnt == UnknownLength {
+			n = gen.st.stack[i].lenAt
+			break
 		}
-		gen.c += gen.bufn
-		gen.bufn = 0
+	}
+	if n == 0 {
+		return nil
 	}
 
+	if _, err := gen.w.Write(gen.buf[:n]); err != nil {
+		// We don't know how much of the buffer made it out, so the stream can't be continued.
+		gen.err = err
+		return err
+	}
+	gen.c += n
+	copy(gen.buf, gen.buf[n:gen.bufn])
+	gen.bufn -= n
+
+	for i := 0; i < gen.st.sz; i++ {
+		if gen.st.stack[i].cnt == UnknownLength {
+			gen.st.stack[i].lenAt -= n
+		}
+	}
 	return nil
 }
 
@@ -605,22 +1698,39 @@ const (
 	genStTop = iota
 	genStArr
 	genStHash
+	genStHashDef
 	genStIVar
 	genStObj
 	genStUsrMarsh
 	genStStruct
+	genStExtended
+	genStUsrClass
+	genStData
 )
 
+// genSym is an entry in the Generator symbol table.
+type genSym struct {
+	id    int // symlink id
+	epoch int // the stream the symbol was last written in
+}
+
 type genStateItem struct {
 	cnt int
 	pos int
 	typ uint8
+	id  int // distinguishes this context from others that occupied the same stack slot
+
+	lnkDefer bool // the value of this IVar is assigned a link id once the IVar is finished
+	encOK    bool // the value of this IVar has an encoding
+	lenAt    int  // buffer offset of the length of an array/hash, patched on completion if cnt is UnknownLength
 }
 
 func (st *genStateItem) reset(sz int, typ uint8) {
 	st.cnt = sz
 	st.pos = 0
 	st.typ = typ
+	st.lnkDefer = false
+	st.encOK = false
 }
 
 type genState struct {
@@ -628,6 +1738,7 @@ type genState struct {
 	cap   int
 	sz    int
 	cur   *genStateItem
+	ids   int
 }
 
 // Resets generator state back to initial state (which is ready for a new
@@ -649,6 +1760,8 @@ func (st *genState) push(typ uint8, cnt int) {
 
 	st.cur = &st.stack[st.sz]
 	st.cur.reset(cnt, typ)
+	st.ids++
+	st.cur.id = st.ids
 	st.sz++
 }
 
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/big"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/samcday/rmarsh"
@@ -24,6 +28,20 @@ func testGenerator(t *testing.T, exp string, f func(gen *rmarsh.Generator) error
 	}
 }
 
+// testGeneratorRuby checks the generated stream is byte for byte identical to what Ruby generates for given expr.
+func testGeneratorRuby(t *testing.T, expr string, f func(gen *rmarsh.Generator) error) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := f(gen); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := rbEncode(t, expr)
+	if !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated stream for %s:\n%s\n!= expected:\n%s", expr, hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+}
+
 func TestGenNil(t *testing.T) {
 	testGenerator(t, "nil", func(gen *rmarsh.Generator) error {
 		return gen.Nil()
@@ -138,6 +156,24 @@ func TestGenSymbol(t *testing.T) {
 	})
 }
 
+func TestGenSymbolEnc(t *testing.T) {
+	testGeneratorRuby(t, `[:test, :"f\u00f6\u00f6", :"f\u00f6\u00f6"]`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(3); err != nil {
+			return err
+		}
+		if err := gen.SymbolEnc("test", rmarsh.EncodingUTF8); err != nil {
+			return err
+		}
+		if err := gen.SymbolEnc("f\u00f6\u00f6", rmarsh.EncodingUTF8); err != nil {
+			return err
+		}
+		if err := gen.SymbolEnc("f\u00f6\u00f6", rmarsh.EncodingUTF8); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
 func BenchmarkGenSymbol(b *testing.B) {
 	gen := rmarsh.NewGenerator(ioutil.Discard)
 
@@ -150,12 +186,266 @@ func BenchmarkGenSymbol(b *testing.B) {
 	}
 }
 
+func TestGenManySymbols(t *testing.T) {
+	testGeneratorRuby(t, `(0...1000).map { |i| :"sym#{i}" } * 2`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(2000); err != nil {
+			return err
+		}
+		for i := 0; i < 2000; i++ {
+			if err := gen.Symbol(fmt.Sprintf("sym%d", i%1000)); err != nil {
+				return err
+			}
+		}
+		return gen.EndArray()
+	})
+}
+
+func BenchmarkGenManySymbols(b *testing.B) {
+	syms := make([]string, 5000)
+	for i := range syms {
+		syms[i] = fmt.Sprintf("sym%d", i)
+	}
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gen.Reset(nil)
+
+		if err := gen.StartArray(len(syms)); err != nil {
+			b.Fatal(err)
+		}
+		for _, sym := range syms {
+			if err := gen.Symbol(sym); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := gen.EndArray(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Writes an array of n objects, each with 30 ivars.
+func genObjectIVars(tb testing.TB, gen *rmarsh.Generator, ivars []string, n int) {
+	if err := gen.StartArray(n); err != nil {
+		tb.Fatal(err)
+	}
+	for j := 0; j < n; j++ {
+		if err := gen.StartObject("Object", len(ivars)); err != nil {
+			tb.Fatal(err)
+		}
+		for _, ivar := range ivars {
+			if err := gen.Symbol(ivar); err != nil {
+				tb.Fatal(err)
+			}
+			if err := gen.Nil(); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if err := gen.EndObject(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := gen.EndArray(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func objectIVars() []string {
+	ivars := make([]string, 30)
+	for i := range ivars {
+		ivars[i] = fmt.Sprintf("@ivar%d", i)
+	}
+	return ivars
+}
+
+func BenchmarkGenManyObjectIVars(b *testing.B) {
+	ivars := objectIVars()
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gen.Reset(nil)
+		genObjectIVars(b, gen, ivars, 1000)
+	}
+}
+
+func BenchmarkGenManyObjectIVarsFresh(b *testing.B) {
+	// A fresh Generator has to grow its buffer to hold the whole stream.
+	ivars := objectIVars()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		genObjectIVars(b, rmarsh.NewGenerator(ioutil.Discard), ivars, 10000)
+	}
+}
+
+func TestGenBufferGrowth(t *testing.T) {
+	// The buffer must grow geometrically, otherwise large streams take quadratic time.
+	ivars := objectIVars()
+	allocs := testing.AllocsPerRun(1, func() {
+		genObjectIVars(t, rmarsh.NewGenerator(ioutil.Discard), ivars, 10000)
+	})
+	if allocs > 100 {
+		t.Errorf("Generating 10000 objects took %v allocs", allocs)
+	}
+}
+
 func TestGenString(t *testing.T) {
 	testGenerator(t, `"foobar"`, func(gen *rmarsh.Generator) error {
 		return gen.String("foobar")
 	})
 }
 
+func TestGenStringEnc(t *testing.T) {
+	for expr, enc := range map[string]string{
+		`"f\u00f6\u00f6"`:                      rmarsh.EncodingUTF8,
+		`"foo".force_encoding("US-ASCII")`:     rmarsh.EncodingASCII,
+		`"foo".b`:                              rmarsh.EncodingBinary,
+		`"foo".force_encoding("Shift_JIS")`:    "Shift_JIS",
+		`"foo".force_encoding("Windows-1252")`: "Windows-1252",
+	} {
+		str := "foo"
+		if enc == rmarsh.EncodingUTF8 {
+			str = "f\u00f6\u00f6"
+		}
+		enc := enc
+		testGeneratorRuby(t, expr, func(gen *rmarsh.Generator) error {
+			return gen.StringEnc(str, enc)
+		})
+	}
+}
+
+func TestGenStringEncLink(t *testing.T) {
+	// Ruby writes the name of an encoding once per stream, and links to it thereafter.
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringEnc("a", "Shift_JIS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringEnc("b", "Shift_JIS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []byte("\x04\x08[\x07I\"\x06a\x06:\x0dencoding\"\x0eShift_JISI\"\x06b\x06;\x00@\x07")
+	if !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+}
+
+func BenchmarkGenStringEnc(b *testing.B) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+
+	for i := 0; i < b.N; i++ {
+		gen.Reset(nil)
+
+		if err := gen.StringEnc("test", rmarsh.EncodingUTF8); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGenStringFrom(t *testing.T) {
+	testGeneratorRuby(t, `["foo".b, ("x" * 1000).b, "bar"]`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(3); err != nil {
+			return err
+		}
+		if err := gen.String("foo"); err != nil {
+			return err
+		}
+		if err := gen.StringFrom(strings.NewReader(strings.Repeat("x", 1000)), 1000); err != nil {
+			return err
+		}
+		if err := gen.StartIVar(1); err != nil {
+			return err
+		}
+		if err := gen.StringFrom(strings.NewReader("bar"), 3); err != nil {
+			return err
+		}
+		if err := gen.Symbol("E"); err != nil {
+			return err
+		}
+		if err := gen.Bool(true); err != nil {
+			return err
+		}
+		if err := gen.EndIVar(); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func TestGenStringFromShortRead(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringFrom(strings.NewReader("foo"), 4); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	// The stream is incomplete, so nothing else can be written to it.
+	if err := gen.Nil(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error %+v", err)
+	}
+	if err := gen.EndArray(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error %+v", err)
+	}
+	if err := gen.Flush(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error %+v", err)
+	}
+	if err := gen.Reset(nil); err != rmarsh.ErrGeneratorUnfinished {
+		t.Errorf("Unexpected error %+v", err)
+	}
+
+	b.Reset()
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte{0x04, 0x08, '0'}; !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestGenUserDefinedFromWriteError(t *testing.T) {
+	gen := rmarsh.NewGenerator(failingWriter{})
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.UserDefinedObjectFrom("Foo", strings.NewReader("foo"), 3); err != io.ErrClosedPipe {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	if err := gen.UserDefinedObject("Foo", "bar"); err != io.ErrClosedPipe {
+		t.Errorf("Unexpected error %+v", err)
+	}
+}
+
+func TestGenStringFromUnknownLength(t *testing.T) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	if err := gen.StartArray(rmarsh.UnknownLength); err != nil {
+		t.Fatal(err)
+	}
+	err := gen.StringFrom(strings.NewReader("foo"), 3)
+	if err == nil || err.Error() != "StringFrom() called inside of context of array or hash with unknown length" {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
 func BenchmarkGenString(b *testing.B) {
 	gen := rmarsh.NewGenerator(ioutil.Discard)
 
@@ -174,6 +464,20 @@ func TestGenFloat(t *testing.T) {
 	})
 }
 
+func TestGenFloatSpecial(t *testing.T) {
+	for expected, f := range map[string]float64{
+		"Infinity":  math.Inf(1),
+		"-Infinity": math.Inf(-1),
+		"NaN":       math.NaN(),
+		"-0.0":      math.Copysign(0, -1),
+	} {
+		f := f
+		testGenerator(t, expected, func(gen *rmarsh.Generator) error {
+			return gen.Float(f)
+		})
+	}
+}
+
 func BenchmarkGenFloat(b *testing.B) {
 	gen := rmarsh.NewGenerator(ioutil.Discard)
 
@@ -217,6 +521,33 @@ func TestGenArrayOverflow(t *testing.T) {
 	}
 }
 
+func TestGenArrayUnknownLength(t *testing.T) {
+	testGeneratorRuby(t, `[[], (1..200).to_a]`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(rmarsh.UnknownLength); err != nil {
+			return err
+		}
+		if err := gen.StartArray(rmarsh.UnknownLength); err != nil {
+			return err
+		}
+		if err := gen.EndArray(); err != nil {
+			return err
+		}
+		// The length of this array doesn't fit in the single byte reserved for it.
+		if err := gen.StartArray(rmarsh.UnknownLength); err != nil {
+			return err
+		}
+		for i := 1; i <= 200; i++ {
+			if err := gen.Fixnum(int64(i)); err != nil {
+				return err
+			}
+		}
+		if err := gen.EndArray(); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
 func BenchmarkGenArray(b *testing.B) {
 	gen := rmarsh.NewGenerator(ioutil.Discard)
 
@@ -451,6 +782,12 @@ func TestGenUserDefined(t *testing.T) {
 	})
 }
 
+func TestGenUserDefinedFrom(t *testing.T) {
+	testGenerator(t, `UsrDef<"test">`, func(gen *rmarsh.Generator) error {
+		return gen.UserDefinedObjectFrom("UsrDef", strings.NewReader("test"), 4)
+	})
+}
+
 func BenchmarkGenUserDefined(b *testing.B) {
 	gen := rmarsh.NewGenerator(ioutil.Discard)
 
@@ -469,6 +806,12 @@ func TestGenRegexp(t *testing.T) {
 	})
 }
 
+func TestGenRegexpEnc(t *testing.T) {
+	testGeneratorRuby(t, `/test/i`, func(gen *rmarsh.Generator) error {
+		return gen.RegexpEnc("test", rmarsh.RegexpIgnoreCase, rmarsh.EncodingASCII)
+	})
+}
+
 func TestGenStruct(t *testing.T) {
 	testGenerator(t, `TestStruct<"test">`, func(gen *rmarsh.Generator) error {
 		if err := gen.StartStruct("TestStruct", 1); err != nil {
@@ -504,3 +847,1038 @@ func BenchmarkGenStruct(b *testing.B) {
 		}
 	}
 }
+
+func TestGenExtended(t *testing.T) {
+	testGenerator(t, `TestExtended<#Object<>>`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartExtended("TestExtended"); err != nil {
+			return err
+		}
+		if err := gen.StartObject("Object", 0); err != nil {
+			return err
+		}
+		if err := gen.EndObject(); err != nil {
+			return err
+		}
+		return gen.EndExtended()
+	})
+}
+
+func TestGenExtendedPremature(t *testing.T) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	if err := gen.StartExtended("TestExtended"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndExtended(); err == nil || err.Error() != "EndExtended() called prematurely, extended object not yet written" {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
+func TestGenUserClass(t *testing.T) {
+	testGenerator(t, `UsrClassArray<[nil]>`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartUserClass("UsrClassArray"); err != nil {
+			return err
+		}
+		if err := gen.StartArray(1); err != nil {
+			return err
+		}
+		if err := gen.Nil(); err != nil {
+			return err
+		}
+		if err := gen.EndArray(); err != nil {
+			return err
+		}
+		return gen.EndUserClass()
+	})
+}
+
+func TestGenUserClassIVar(t *testing.T) {
+	testGenerator(t, `"test"`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartIVar(1); err != nil {
+			return err
+		}
+		if err := gen.StartUserClass("String"); err != nil {
+			return err
+		}
+		if err := gen.String("test"); err != nil {
+			return err
+		}
+		if err := gen.EndUserClass(); err != nil {
+			return err
+		}
+		if err := gen.Symbol("E"); err != nil {
+			return err
+		}
+		if err := gen.Bool(true); err != nil {
+			return err
+		}
+		return gen.EndIVar()
+	})
+}
+
+func TestGenHashWithDefault(t *testing.T) {
+	testGenerator(t, `{:foo=>123}<default=0>`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartHashWithDefault(1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("foo"); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(123); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(0); err != nil {
+			return err
+		}
+		return gen.EndHash()
+	})
+}
+
+func TestGenHashUnknownLength(t *testing.T) {
+	testGenerator(t, `[{:foo=>123}, {:bar=>456}<default=0>]`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(2); err != nil {
+			return err
+		}
+		if err := gen.StartHash(rmarsh.UnknownLength); err != nil {
+			return err
+		}
+		if err := gen.Symbol("foo"); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(123); err != nil {
+			return err
+		}
+		if err := gen.EndHash(); err != nil {
+			return err
+		}
+		if err := gen.StartHashWithDefault(rmarsh.UnknownLength); err != nil {
+			return err
+		}
+		if err := gen.Symbol("bar"); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(456); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(0); err != nil {
+			return err
+		}
+		if err := gen.EndHash(); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func TestGenHashUnknownLengthPremature(t *testing.T) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	if err := gen.StartHash(rmarsh.UnknownLength); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndHash(); err == nil || err.Error() != "EndHash() called prematurely, 1 elems written" {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
+func TestGenHashWithDefaultPremature(t *testing.T) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	if err := gen.StartHashWithDefault(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndHash(); err == nil || err.Error() != "EndHash() called prematurely, 0 of 1 elems written" {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
+func TestGenData(t *testing.T) {
+	// Ruby can only load typed data into classes implemented in C, so we check the raw output instead.
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.StartData("Data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartArray(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndData(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []byte{0x04, 0x08, 'd', ':', 0x09, 'D', 'a', 't', 'a', '[', 0x00}
+	if !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+}
+
+func TestGenLink(t *testing.T) {
+	testGenerator(t, `["foo", "foo"]`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(2); err != nil {
+			return err
+		}
+		id := gen.NextLinkID()
+		if err := gen.String("foo"); err != nil {
+			return err
+		}
+		if err := gen.Link(id); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func TestGenLinkCyclic(t *testing.T) {
+	testGenerator(t, `[[...]]`, func(gen *rmarsh.Generator) error {
+		id := gen.NextLinkID()
+		if err := gen.StartArray(1); err != nil {
+			return err
+		}
+		if err := gen.Link(id); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func TestGenLinkInvalid(t *testing.T) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Link(1); err == nil || err.Error() != "Link id 1 not valid, 1 linkable values written" {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
+func BenchmarkGenLink(b *testing.B) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+
+	for i := 0; i < b.N; i++ {
+		gen.Reset(nil)
+
+		if err := gen.StartArray(1); err != nil {
+			b.Fatal(err)
+		}
+		if err := gen.Link(0); err != nil {
+			b.Fatal(err)
+		}
+		if err := gen.EndArray(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// countingWriter records how many writes the Generator made to it.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+func genStrings(t *testing.T, gen *rmarsh.Generator, l, n int) {
+	if err := gen.StartArray(l); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := gen.String("test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenFlushThreshold(t *testing.T) {
+	exp := new(bytes.Buffer)
+	genStrings(t, rmarsh.NewGenerator(exp), 100, 100)
+
+	w := new(countingWriter)
+	gen := rmarsh.NewGenerator(w)
+	gen.SetFlushThreshold(32)
+	genStrings(t, gen, 100, 100)
+
+	if w.writes < 2 {
+		t.Errorf("Expected multiple writes, got %d", w.writes)
+	}
+	if !bytes.Equal(w.Bytes(), exp.Bytes()) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(w.Bytes()), hex.Dump(exp.Bytes()))
+	}
+}
+
+func TestGenFlushThresholdUnknownLength(t *testing.T) {
+	exp := new(bytes.Buffer)
+	genStrings(t, rmarsh.NewGenerator(exp), 200, 200)
+
+	w := new(countingWriter)
+	gen := rmarsh.NewGenerator(w)
+	gen.SetFlushThreshold(32)
+	genStrings(t, gen, rmarsh.UnknownLength, 200)
+
+	if !bytes.Equal(w.Bytes(), exp.Bytes()) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(w.Bytes()), hex.Dump(exp.Bytes()))
+	}
+}
+
+func TestGenFlush(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte{0x04, 0x08, '[', 0x07, '0'}; !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Flushed stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte{0x04, 0x08, '[', 0x07, '0', '0'}; !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+}
+
+func TestGenFlushUnknownLength(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.StartArray(rmarsh.UnknownLength); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The array length isn't known yet, so it and the elements after it must be held back.
+	if exp := []byte{0x04, 0x08, '['}; !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Flushed stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte{0x04, 0x08, '[', 0x06, '0'}; !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+}
+
+func TestGenBytes(t *testing.T) {
+	testGenerator(t, `["foo", :bar, UsrDef<"test">, /test/i, :bar]`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(5); err != nil {
+			return err
+		}
+		if err := gen.StartIVar(1); err != nil {
+			return err
+		}
+		if err := gen.StringBytes([]byte("foo")); err != nil {
+			return err
+		}
+		if err := gen.SymbolBytes([]byte("E")); err != nil {
+			return err
+		}
+		if err := gen.Bool(true); err != nil {
+			return err
+		}
+		if err := gen.EndIVar(); err != nil {
+			return err
+		}
+		if err := gen.SymbolBytes([]byte("bar")); err != nil {
+			return err
+		}
+		if err := gen.UserDefinedObjectBytes("UsrDef", []byte("test")); err != nil {
+			return err
+		}
+		if err := gen.RegexpBytes([]byte("test"), rmarsh.RegexpIgnoreCase); err != nil {
+			return err
+		}
+		if err := gen.SymbolBytes([]byte("bar")); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func TestGenAppend(t *testing.T) {
+	exp := new(bytes.Buffer)
+	genStrings(t, rmarsh.NewGenerator(exp), 2, 2)
+
+	w := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(w)
+	gen.ResetAppend([]byte("prefix"))
+	genStrings(t, gen, 2, 2)
+
+	if b := gen.Bytes(); !bytes.Equal(b, append([]byte("prefix"), exp.Bytes()...)) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b), hex.Dump(exp.Bytes()))
+	}
+	if w.Len() != 0 {
+		t.Fatalf("Unexpected write to io.Writer:\n%s", hex.Dump(w.Bytes()))
+	}
+
+	// Once reset, the Generator goes back to writing to the io.Writer.
+	b := gen.Bytes()
+	gen.Reset(nil)
+	genStrings(t, gen, 2, 2)
+	if !bytes.Equal(w.Bytes(), exp.Bytes()) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(w.Bytes()), hex.Dump(exp.Bytes()))
+	}
+	if gen.Bytes() != nil {
+		t.Fatalf("Bytes() should be nil when not appending")
+	}
+	if !bytes.Equal(b, append([]byte("prefix"), exp.Bytes()...)) {
+		t.Fatalf("Appended stream was modified:\n%s", hex.Dump(b))
+	}
+}
+
+func BenchmarkGenAppend(b *testing.B) {
+	str, sym := []byte("test"), []byte("test")
+	dst := make([]byte, 0, 64)
+	gen := rmarsh.NewGenerator(nil)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		gen.ResetAppend(dst[:0])
+
+		if err := gen.StartArray(3); err != nil {
+			b.Fatal(err)
+		}
+		if err := gen.StringBytes(str); err != nil {
+			b.Fatal(err)
+		}
+		if err := gen.SymbolBytes(sym); err != nil {
+			b.Fatal(err)
+		}
+		if err := gen.SymbolBytes(sym); err != nil {
+			b.Fatal(err)
+		}
+		if err := gen.EndArray(); err != nil {
+			b.Fatal(err)
+		}
+		dst = gen.Bytes()
+	}
+}
+
+func TestGenRaw(t *testing.T) {
+	frag := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(frag)
+	if err := gen.StartArray(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.String("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Link(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fragment's symbol and link are numbered relative to the fragment, they should be rebased when spliced in.
+	exp := new(bytes.Buffer)
+	gen.Reset(exp)
+	for _, f := range []func() error{
+		func() error { return gen.StartArray(3) },
+		func() error { return gen.Symbol("baz") },
+		func() error { return gen.Symbol("foo") },
+		func() error { return gen.StartArray(4) },
+		func() error { return gen.Symbol("foo") },
+		func() error { return gen.String("bar") },
+		func() error { return gen.Link(2) },
+		func() error { return gen.Symbol("foo") },
+		func() error { return gen.EndArray() },
+		func() error { return gen.EndArray() },
+	} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := new(bytes.Buffer)
+	gen.Reset(b)
+	if err := gen.StartArray(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Raw(frag.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if id := gen.NextLinkID(); id != 3 {
+		t.Errorf("NextLinkID() = %d, expected 3", id)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b.Bytes(), exp.Bytes()) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp.Bytes()))
+	}
+}
+
+func TestGenRawIVarSymbol(t *testing.T) {
+	// A non ASCII symbol is wrapped in an IVar for its encoding, it still doesn't occupy a link id.
+	frag := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(frag)
+	if err := gen.SymbolEnc("\u65e5\u672c", "UTF-8"); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := new(bytes.Buffer)
+	gen.Reset(exp)
+	for _, f := range []func() error{
+		func() error { return gen.StartArray(3) },
+		func() error { return gen.String("x") },
+		func() error { return gen.SymbolEnc("\u65e5\u672c", "UTF-8") },
+		func() error { return gen.Link(1) },
+		func() error { return gen.EndArray() },
+	} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := new(bytes.Buffer)
+	gen.Reset(b)
+	if err := gen.StartArray(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.String("x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Raw(frag.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if id := gen.NextLinkID(); id != 2 {
+		t.Errorf("NextLinkID() = %d, expected 2", id)
+	}
+	if err := gen.Link(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b.Bytes(), exp.Bytes()) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp.Bytes()))
+	}
+}
+
+func TestGenRawRuby(t *testing.T) {
+	frag := rbEncode(t, `s = "bar".b; [:foo, s, s, {:foo=>1}]`)
+	testGenerator(t, `[:foo, "baz", [:foo, "bar", "bar", {:foo=>1}]]`, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(3); err != nil {
+			return err
+		}
+		if err := gen.Symbol("foo"); err != nil {
+			return err
+		}
+		if err := gen.String("baz"); err != nil {
+			return err
+		}
+		if err := gen.Raw(frag); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func TestGenRawInvalid(t *testing.T) {
+	for frag, msg := range map[string]string{
+		"\x04\x09\x30":     "Raw() called with invalid fragment, expected a Marshal 4.8 stream",
+		"\x04\x08[\x06":    "Raw() called with invalid fragment: unexpected EOF",
+		"\x04\x08\x30\x30": "Raw() called with invalid fragment, 1 trailing bytes",
+		"\x04\x08\"\xfa":   "Raw() called with invalid fragment: Invalid TokenString length -1",
+	} {
+		gen := rmarsh.NewGenerator(ioutil.Discard)
+		if err := gen.Raw([]byte(frag)); err == nil || err.Error() != msg {
+			t.Errorf("Unexpected error %+v", err)
+		}
+	}
+}
+
+func TestGenRollback(t *testing.T) {
+	// The stream written with a rollback should be identical to one where the discarded values were never written.
+	exp := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(exp)
+	if err := gen.StartArray(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringEnc("foo", "Shift_JIS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartArray(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringEnc("quux", "EUC-JP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Link(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := new(bytes.Buffer)
+	gen = rmarsh.NewGenerator(b)
+	if err := gen.StartArray(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringEnc("foo", "Shift_JIS"); err != nil {
+		t.Fatal(err)
+	}
+	cp := gen.Checkpoint()
+	if err := gen.StartHash(rmarsh.UnknownLength); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringEnc("qux", "EUC-JP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Rollback(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartArray(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringEnc("quux", "EUC-JP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Link(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b.Bytes(), exp.Bytes()) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp.Bytes()))
+	}
+}
+
+func TestGenRollbackSymbols(t *testing.T) {
+	// Symbols written after the Checkpoint must not be linked to once they've been rolled back.
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	cp := gen.Checkpoint()
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Rollback(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []byte{0x04, 0x08, '[', 0x07, ':', 0x08, 'b', 'a', 'r', ':', 0x08, 'f', 'o', 'o'}
+	if !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+}
+
+func TestGenRollbackInvalid(t *testing.T) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	gen.SetFlushThreshold(1)
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	cp := gen.Checkpoint()
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Rollback(cp); err == nil || err.Error() != "Rollback() not possible, 1 bytes past Checkpoint already flushed" {
+		t.Errorf("Unexpected error %+v", err)
+	}
+
+	gen.Reset(nil)
+	gen.SetFlushThreshold(0)
+	if err := gen.StartArray(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartArray(1); err != nil {
+		t.Fatal(err)
+	}
+	cp = gen.Checkpoint()
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Rollback(cp); err == nil || err.Error() != "Rollback() called after context of Checkpoint was ended" {
+		t.Errorf("Unexpected error %+v", err)
+	}
+
+	gen.Reset(nil)
+	if err := gen.Rollback(cp); err == nil || err.Error() != "Rollback() called with Checkpoint from another Marshal stream" {
+		t.Errorf("Unexpected error %+v", err)
+	}
+}
+
+func TestGenState(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	gen.SetFlushThreshold(4)
+
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.String("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartHash(rmarsh.UnknownLength); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartIVar(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if gen.Done() {
+		t.Errorf("Done() true for unfinished stream")
+	}
+	if gen.Depth() != 3 {
+		t.Errorf("Depth() %d != 3", gen.Depth())
+	}
+	exp := []rmarsh.GenPathItem{
+		{Kind: rmarsh.TokenStartArray, Pos: 1, Len: 2},
+		{Kind: rmarsh.TokenStartHash, Pos: 1, Len: rmarsh.UnknownLength},
+		{Kind: rmarsh.TokenStartIVar, Pos: -1, Len: 2},
+	}
+	if path := gen.Path(); !reflect.DeepEqual(path, exp) {
+		t.Errorf("Path() %+v != %+v", path, exp)
+	}
+	// Part of the stream has been flushed, the rest is buffered.
+	if gen.Len() != 17 || b.Len() != 10 {
+		t.Errorf("Len() %d != 17, %d bytes written", gen.Len(), b.Len())
+	}
+
+	if err := gen.String("baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("E"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Bool(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndIVar(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndHash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !gen.Done() {
+		t.Errorf("Done() false for finished stream")
+	}
+	if gen.Depth() != 0 || len(gen.Path()) != 0 {
+		t.Errorf("Depth() %d != 0, Path() %+v", gen.Depth(), gen.Path())
+	}
+	if gen.Len() != b.Len() {
+		t.Errorf("Len() %d != %d bytes written", gen.Len(), b.Len())
+	}
+}
+
+func TestGenStateHashDefault(t *testing.T) {
+	// A Parser emits TokenStartHash for a hash with a default value too.
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	if err := gen.StartHashWithDefault(1); err != nil {
+		t.Fatal(err)
+	}
+	exp := []rmarsh.GenPathItem{{Kind: rmarsh.TokenStartHash, Pos: 0, Len: 3}}
+	if path := gen.Path(); !reflect.DeepEqual(path, exp) {
+		t.Errorf("Path() %+v != %+v", path, exp)
+	}
+}
+
+func TestGenLenAppend(t *testing.T) {
+	gen := rmarsh.NewGenerator(nil)
+	if err := gen.ResetAppend([]byte("prefix")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if gen.Len() != 7 {
+		t.Errorf("Len() %d != 7", gen.Len())
+	}
+}
+
+func TestGenResetUnfinished(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.Reset(nil); err != nil {
+		t.Errorf("Unexpected error %+v", err)
+	}
+	if err := gen.StartArray(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Reset(nil); err != rmarsh.ErrGeneratorUnfinished {
+		t.Errorf("Unexpected error %+v", err)
+	}
+	// The Generator is reset regardless.
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte{0x04, 0x08, '0'}; !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated stream:\n%s\n!= expected:\n%s", hex.Dump(b.Bytes()), hex.Dump(exp))
+	}
+	if err := gen.ResetAppend(nil); err != nil {
+		t.Errorf("Unexpected error %+v", err)
+	}
+}
+
+func TestGenStrict(t *testing.T) {
+	for _, tc := range []struct {
+		msg string
+		f   func(gen *rmarsh.Generator) error
+	}{
+		{`StartObject() called with invalid constant name "my_class"`, func(gen *rmarsh.Generator) error {
+			return gen.StartObject("my_class", 0)
+		}},
+		{`Class() called with invalid constant name "Foo::"`, func(gen *rmarsh.Generator) error {
+			return gen.Class("Foo::")
+		}},
+		{`Module() called with invalid constant name "Foo:Bar"`, func(gen *rmarsh.Generator) error {
+			return gen.Module("Foo:Bar")
+		}},
+		{`StartStruct() called with invalid constant name "::Foo"`, func(gen *rmarsh.Generator) error {
+			return gen.StartStruct("::Foo", 0)
+		}},
+		{`StartUserMarshalled() called with invalid constant name ""`, func(gen *rmarsh.Generator) error {
+			return gen.StartUserMarshalled("")
+		}},
+		{`UserDefinedObject() called with invalid constant name "Foo Bar"`, func(gen *rmarsh.Generator) error {
+			return gen.UserDefinedObject("Foo Bar", "")
+		}},
+		{`Invalid instance var name "user" written to object`, func(gen *rmarsh.Generator) error {
+			if err := gen.StartObject("Foo::Bar", 1); err != nil {
+				return err
+			}
+			return gen.Symbol("user")
+		}},
+		{`Invalid instance var name "@1" written to object`, func(gen *rmarsh.Generator) error {
+			if err := gen.StartObject("Foo", 1); err != nil {
+				return err
+			}
+			return gen.SymbolBytes([]byte("@1"))
+		}},
+		{`Invalid struct member name "@user"`, func(gen *rmarsh.Generator) error {
+			if err := gen.StartStruct("Foo", 1); err != nil {
+				return err
+			}
+			return gen.Symbol("@user")
+		}},
+		{`Invalid instance var name "foo" written to IVar`, func(gen *rmarsh.Generator) error {
+			if err := gen.StartIVar(1); err != nil {
+				return err
+			}
+			if err := gen.String("foo"); err != nil {
+				return err
+			}
+			return gen.Symbol("foo")
+		}},
+		{`Encoding instance var "E" written to IVar of value that has no encoding`, func(gen *rmarsh.Generator) error {
+			if err := gen.StartIVar(1); err != nil {
+				return err
+			}
+			if err := gen.StartArray(0); err != nil {
+				return err
+			}
+			if err := gen.EndArray(); err != nil {
+				return err
+			}
+			return gen.Symbol("E")
+		}},
+		{`Encoding instance var "encoding" written to IVar of value that has no encoding`, func(gen *rmarsh.Generator) error {
+			if err := gen.StartIVar(1); err != nil {
+				return err
+			}
+			if err := gen.StartHash(0); err != nil {
+				return err
+			}
+			if err := gen.EndHash(); err != nil {
+				return err
+			}
+			return gen.Raw([]byte("\x04\x08:\x0dencoding"))
+		}},
+		{`Encoding instance var "E" written to IVar of value that has no encoding`, func(gen *rmarsh.Generator) error {
+			if err := gen.StartIVar(1); err != nil {
+				return err
+			}
+			if err := gen.StartUserClass("Foo"); err != nil {
+				return err
+			}
+			if err := gen.StartArray(0); err != nil {
+				return err
+			}
+			if err := gen.EndArray(); err != nil {
+				return err
+			}
+			if err := gen.EndUserClass(); err != nil {
+				return err
+			}
+			return gen.Symbol("E")
+		}},
+		{`Encoding instance var "E" written to IVar of value that has no encoding`, func(gen *rmarsh.Generator) error {
+			if err := gen.StartIVar(1); err != nil {
+				return err
+			}
+			if err := gen.Raw([]byte("\x04\x08C:\x08Foo[\x00")); err != nil {
+				return err
+			}
+			return gen.Symbol("E")
+		}},
+	} {
+		gen := rmarsh.NewGenerator(ioutil.Discard)
+		gen.SetStrict(true)
+		if err := tc.f(gen); err == nil || err.Error() != tc.msg {
+			t.Errorf("Unexpected error %+v, expected %q", err, tc.msg)
+		}
+	}
+}
+
+func TestGenStrictValid(t *testing.T) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	gen.SetStrict(true)
+	if err := gen.StartArray(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartObject("Foo::Bar2", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("@user_id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Fixnum(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndObject(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartStruct("Point", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Fixnum(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndStruct(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StringEnc("foo", "Shift_JIS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartIVar(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartUserClass("MyString"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.String("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndUserClass(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("E"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Bool(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("@extra"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndIVar(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.StartIVar(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.UserDefinedObject("Foo", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("E"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Bool(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndIVar(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,8 +1,12 @@
 package rmarsh
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"strconv"
 
 	"github.com/pkg/errors"
 )
@@ -31,28 +35,52 @@ const (
 	TokenEndIVar
 	TokenLink
 	TokenUsrMarshal
+	TokenUsrDef
+	TokenStartObject
+	TokenEndObject
+	TokenStartStruct
+	TokenEndStruct
+	TokenClass
+	TokenModule
+	TokenRegexp
+	TokenExtended
+	TokenUsrClass
+	TokenHashDefault
+	TokenData
 	TokenEOF
 )
 
 var tokenNames = map[Token]string{
-	TokenNil:        "TokenNil",
-	TokenTrue:       "TokenTrue",
-	TokenFalse:      "TokenFalse",
-	TokenFixnum:     "TokenFixnum",
-	TokenFloat:      "TokenFloat",
-	TokenBignum:     "TokenBignum",
-	TokenSymbol:     "TokenSymbol",
-	TokenString:     "TokenString",
-	TokenStartArray: "TokenStartArray",
-	TokenEndArray:   "TokenEndArray",
-	TokenStartHash:  "TokenStartHash",
-	TokenEndHash:    "TokenEndHash",
-	TokenStartIVar:  "TokenStartIVar",
-	TokenIVarProps:  "TokenIVarProps",
-	TokenEndIVar:    "TokenEndIVar",
-	TokenLink:       "TokenLink",
-	TokenUsrMarshal: "TokenUsrMarshal",
-	TokenEOF:        "EOF",
+	TokenNil:         "TokenNil",
+	TokenTrue:        "TokenTrue",
+	TokenFalse:       "TokenFalse",
+	TokenFixnum:      "TokenFixnum",
+	TokenFloat:       "TokenFloat",
+	TokenBignum:      "TokenBignum",
+	TokenSymbol:      "TokenSymbol",
+	TokenString:      "TokenString",
+	TokenStartArray:  "TokenStartArray",
+	TokenEndArray:    "TokenEndArray",
+	TokenStartHash:   "TokenStartHash",
+	TokenEndHash:     "TokenEndHash",
+	TokenStartIVar:   "TokenStartIVar",
+	TokenIVarProps:   "TokenIVarProps",
+	TokenEndIVar:     "TokenEndIVar",
+	TokenLink:        "TokenLink",
+	TokenUsrMarshal:  "TokenUsrMarshal",
+	TokenUsrDef:      "TokenUsrDef",
+	TokenStartObject: "TokenStartObject",
+	TokenEndObject:   "TokenEndObject",
+	TokenStartStruct: "TokenStartStruct",
+	TokenEndStruct:   "TokenEndStruct",
+	TokenClass:       "TokenClass",
+	TokenModule:      "TokenModule",
+	TokenRegexp:      "TokenRegexp",
+	TokenExtended:    "TokenExtended",
+	TokenUsrClass:    "TokenUsrClass",
+	TokenHashDefault: "TokenHashDefault",
+	TokenData:        "TokenData",
+	TokenEOF:         "EOF",
 }
 
 func (t Token) String() string {
@@ -93,6 +121,17 @@ type Parser struct {
 	lnkTbl rngTbl // Store ranges marking the linkable objects we've parsed in the read buffer.
 	symTbl rngTbl // Store ranges marking the symbols we've parsed in the read buffer.
 
+	lnkID  int     // id of the linked object this Parser is replaying, -1 if this is a top level Parser.
+	parent *Parser // the Parser that constructed this replay Parser.
+
+	cur      Token // The token we have most recently read.
+	ctx      rng   // Range of the raw data for the current token.
+	cls      rng   // Range of the class name for the current token.
+	bnumsign byte  // Sign of the most recently read Bignum.
+
+	txt bool       // Set if the IVar that just ended wrapped a String, Regexp or Symbol.
+	enc string     // The encoding declared by the IVar that just ended.
+	tc  Transcoder // Used to convert text to UTF-8 in Text().
 }
 
 func NewParser(r io.Reader) *Parser {
@@ -101,22 +140,67 @@ func NewParser(r io.Reader) *Parser {
 		buf:    make([]byte, bufInitSz),
 		bufcap: bufInitSz,
 		state:  parserStateTopLevel,
+		lnkID:  -1,
 	}
 }
 
+// Replay constructs a new Parser that will replay the tokens of a previously parsed linkable object.
+// The replay Parser reads directly from the read buffer of this Parser and never touches the underlying io.Reader.
+// Replay Parsers can themselves construct replay Parsers, for example to resolve a TokenLink encountered during
+// replay. The replay Parser is only valid until the next call to Reset() on the top level Parser.
+func (p *Parser) Replay(lnkID int) (*Parser, error) {
+	// Walk up the parent chain and ensure we aren't replaying something we're already replaying somewhere in the chain.
+	top := p
+	for par := p; par != nil; par = par.parent {
+		if par.lnkID == lnkID {
+			return nil, errors.Errorf("Object ID %d is already being replayed by this Parser", lnkID)
+		}
+		top = par
+	}
+
+	if lnkID < 0 || lnkID >= len(top.lnkTbl) {
+		return nil, errors.Errorf("Object ID %d not valid", lnkID)
+	}
+
+	for _, ctx := range top.stack {
+		if ctx.r == lnkID {
+			return nil, errors.Errorf("Object ID %d is currently being parsed and cannot be replayed", lnkID)
+		}
+	}
+
+	r := top.lnkTbl[lnkID]
+	return &Parser{
+		parent: p,
+		lnkID:  lnkID,
+		state:  parserStateTopLevel,
+		buf:    top.buf,
+		bufcap: r.end,
+		buflen: r.end,
+		pos:    r.beg,
+		lnkTbl: top.lnkTbl,
+		symTbl: top.symTbl,
+		tc:     p.tc,
+	}, nil
+}
+
+// SetTranscoder sets the Transcoder used by Text() to convert text in other encodings to UTF-8.
+// If t is nil, Text() returns the raw bytes of the text.
+func (p *Parser) SetTranscoder(t Transcoder) {
+	p.tc = t
+}
+
 // Reset reverts the Parser into the identity state, ready to read a new Marshal 4.8 stream from the existing Reader.
 // If the provided io.Reader is nil, the existing Reader will continue to be used.
 func (p *Parser) Reset(r io.Reader) {
 	p.stack = p.stack[0:0]
-	// p.cur = tokenInvalid
+	p.cur = tokenInvalid
 	p.state = parserStateTopLevel
 
 	// If this a replay Parser, our reset is a little less ... reset-y.
-	// if p.lnkID > -1 {
-	// 	p.pos = p.lnkTbl[p.lnkID].beg
-	// 	p.stack = p.stack[0:0]
-	// 	return
-	// }
+	if p.lnkID > -1 {
+		p.pos = p.lnkTbl[p.lnkID].beg
+		return
+	}
 
 	if r != nil {
 		p.r = r
@@ -132,11 +216,18 @@ func (p *Parser) Read() (tok Token, b []byte, num int, err error) {
 	// return an EOF token and exit.
 	if p.state == parserStateEOF {
 		tok = TokenEOF
+		p.cur = tok
 		return
 	}
 
 	// Gets set to false after we run SM.
 	runSM := true
+	// Set by the SM if the value we read next must be a Symbol (e.g ivar keys).
+	expectSym := false
+	// Set by the SM if the value we read next shares the link table entry of its enclosing context.
+	lnkSkip := false
+	// Set if the value we read has its link table entry added once its context is finished.
+	lnkDefer := false
 
 	// READ BYTES IF NECESSARY
 	// Running the state machine can bail out back here if there's not enough data in the read buffer
@@ -152,6 +243,12 @@ pullbytes:
 	if needed > 0 {
 		// TODO: port over the stack-based prefetch here.
 
+		// Replay Parsers have no io.Reader, everything they need is already in the read buffer.
+		if p.r == nil {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+
 		from, to := p.buflen, p.buflen+needed
 
 		if to > p.bufcap {
@@ -224,6 +321,8 @@ readNum:
 
 					num |= int(p.buf[pleaseReadNumAt+1+i]) << uint(8*i)
 				}
+				// Account for the leading byte that holds the number of bytes that follow.
+				numSz++
 			}
 		}
 
@@ -232,6 +331,8 @@ readNum:
 	}
 
 	// RUN THE STATE MACHINE
+	// States that don't produce a token of their own jump back here to continue on to the next state.
+sm:
 	if runSM {
 		switch p.state {
 		// the initial state of a Parser expects to read 2-byte magic and then a top level value
@@ -254,6 +355,175 @@ readNum:
 			// Our next state is EOF.
 			// Unless we read something interesting below which pushes something onto the stack.
 			p.state = parserStateEOF
+
+		// state when reading elements of an array
+		case parserStateArray:
+			cur := p.stack.cur()
+			cur.pos++
+			if cur.pos == cur.sz {
+				p.state = parserStateArrayEnd
+			}
+
+		// state when we've finished parsing an array
+		case parserStateArrayEnd:
+			tok = TokenEndArray
+			p.state = p.endCtx()
+			p.cur = tok
+			return
+
+		// state when reading a key in a hash
+		case parserStateHashKey:
+			p.state = parserStateHashValue
+
+		// state when reading a value in a hash
+		case parserStateHashValue:
+			cur := p.stack.cur()
+			cur.pos++
+			if cur.pos < cur.sz {
+				p.state = parserStateHashKey
+			} else if cur.typ == ctxTypeHashDefault {
+				p.state = parserStateHashDefault
+			} else {
+				p.state = parserStateHashEnd
+			}
+
+		// state when we've read all pairs in a hash that has a default value
+		case parserStateHashDefault:
+			tok = TokenHashDefault
+			p.state = parserStateHashDefaultVal
+			p.cur = tok
+			return
+
+		// state when reading the default value of a hash
+		case parserStateHashDefaultVal:
+			p.state = parserStateHashEnd
+
+		// state when we've completed reading a hash
+		case parserStateHashEnd:
+			tok = TokenEndHash
+			p.state = p.endCtx()
+			p.cur = tok
+			return
+
+		// we can end up here if the top level value finished without producing a token, such as a user marshalled
+		// object.
+		case parserStateEOF:
+			tok = TokenEOF
+			p.cur = tok
+			return
+
+		// the first value of an ivar context is the value that the instance vars belong to.
+		case parserStateIVarInit:
+			// Ruby registers the wrapped value in the link table rather than the ivar itself. We already created an
+			// entry covering the whole ivar when we read the 'I', so the value must not get its own.
+			lnkSkip = true
+			p.state = parserStateIVarLen
+
+		// after the ivar value we read the number of instance vars that follow.
+		case parserStateIVarLen:
+			var n, sz int
+			n, sz, needed = p.decodeLong(p.pos)
+			if needed > 0 {
+				goto pullbytes
+			}
+			p.pos += sz
+
+			cur := p.stack.cur()
+			cur.sz = n
+			if n == 0 {
+				p.state = parserStateIVarEnd
+			} else {
+				p.state = parserStateIVarKey
+			}
+
+			tok, num = TokenIVarProps, n
+			p.cur = tok
+			return
+
+		case parserStateIVarKey:
+			expectSym = true
+			p.state = parserStateIVarValue
+
+		case parserStateIVarValue:
+			cur := p.stack.cur()
+			cur.pos++
+			if cur.pos == cur.sz {
+				p.state = parserStateIVarEnd
+			} else {
+				p.state = parserStateIVarKey
+			}
+
+		case parserStateIVarEnd:
+			tok = TokenEndIVar
+			cur := p.stack.cur()
+			p.ctx, p.txt, p.enc = cur.val, cur.txt, cur.enc
+			p.state = p.endCtx()
+			p.cur = tok
+			return
+
+		// the first value of a user marshalled object is the Symbol of its class name.
+		case parserStateUsrMarshalInit:
+			expectSym = true
+			p.state = parserStateUsrMarshalVal
+
+		// then the value that is passed to marshal_load.
+		case parserStateUsrMarshalVal:
+			p.state = parserStateUsrMarshalEnd
+
+		// user marshalled objects don't have an end token, so we pop the context and move straight to the next state.
+		case parserStateUsrMarshalEnd:
+			p.state = p.endCtx()
+			goto sm
+
+		// object instance var names are always Symbols.
+		case parserStateObjectKey:
+			expectSym = true
+			p.state = parserStateObjectValue
+
+		case parserStateObjectValue:
+			cur := p.stack.cur()
+			cur.pos++
+			if cur.pos == cur.sz {
+				p.state = parserStateObjectEnd
+			} else {
+				p.state = parserStateObjectKey
+			}
+
+		case parserStateObjectEnd:
+			tok = TokenEndObject
+			p.state = p.endCtx()
+			p.cur = tok
+			return
+
+		// struct member names are always Symbols.
+		case parserStateStructKey:
+			expectSym = true
+			p.state = parserStateStructValue
+
+		case parserStateStructValue:
+			cur := p.stack.cur()
+			cur.pos++
+			if cur.pos == cur.sz {
+				p.state = parserStateStructEnd
+			} else {
+				p.state = parserStateStructKey
+			}
+
+		case parserStateStructEnd:
+			tok = TokenEndStruct
+			p.state = p.endCtx()
+			p.cur = tok
+			return
+
+		// the value wrapped by an extended or user class wrapper shares the link table entry of the wrapper.
+		case parserStateWrappedVal:
+			lnkSkip = true
+			p.state = parserStateWrappedEnd
+
+		// wrappers don't have an end token, so we pop the context and move straight to the next state.
+		case parserStateWrappedEnd:
+			p.state = p.endCtx()
+			goto sm
 		}
 
 		// Now that we've run the SM, we don't want to run it again if the stream reads
@@ -273,6 +543,7 @@ readNum:
 	typ := p.buf[p.pos]
 	rd := 1
 	linkable := false
+	symIVar := false
 
 	switch typ {
 	case typeNil:
@@ -306,6 +577,10 @@ readNum:
 			needed += 1
 			goto pullbytes
 		}
+		if blobsz < 0 {
+			err = p.parserError("Invalid %s length %d", tok, blobsz)
+			return
+		}
 		rd += sz
 
 		if p.pos+rd+blobsz > p.buflen {
@@ -313,7 +588,51 @@ readNum:
 			goto pullbytes
 		}
 
-		b = p.buf[p.pos+rd : p.pos+rd+blobsz]
+		p.ctx = rng{p.pos + rd, p.pos + rd + blobsz}
+		b = p.buf[p.ctx.beg:p.ctx.end]
+		rd += blobsz
+		linkable = true
+
+	case typeBignum:
+		tok = TokenBignum
+
+		// A Bignum is a sign byte, followed by a long containing the number of shorts that make up the magnitude.
+		// We can safely prefetch the sign byte and the first byte of that long.
+		if p.pos+rd+2 > p.buflen {
+			needed = p.pos + rd + 2 - p.buflen
+			goto pullbytes
+		}
+
+		var blobsz, sz int
+		blobsz, sz, needed = p.decodeLong(p.pos + rd + 1)
+		if needed > 0 {
+			// There's at least one short of magnitude after the long, so we can prefetch that too.
+			needed += 2
+			goto pullbytes
+		}
+		if blobsz < 0 {
+			err = p.parserError("Invalid %s length %d", tok, blobsz)
+			return
+		}
+
+		// For some stupid reason bignums store the length in shorts, not bytes.
+		blobsz = blobsz * 2
+
+		if p.pos+rd+1+sz+blobsz > p.buflen {
+			needed = p.pos + rd + 1 + sz + blobsz - p.buflen
+			goto pullbytes
+		}
+
+		p.bnumsign = p.buf[p.pos+rd]
+		if p.bnumsign == '-' {
+			num = -1
+		} else {
+			num = 1
+		}
+		rd += 1 + sz
+
+		p.ctx = rng{p.pos + rd, p.pos + rd + blobsz}
+		b = p.buf[p.ctx.beg:p.ctx.end]
 		rd += blobsz
 		linkable = true
 
@@ -328,6 +647,81 @@ readNum:
 			needed += 1
 			goto pullbytes
 		}
+		if blobsz < 0 {
+			err = p.parserError("Invalid %s length %d", tok, blobsz)
+			return
+		}
+		rd += sz
+
+		if p.pos+rd+blobsz > p.buflen {
+			needed = p.pos + rd + blobsz - p.buflen
+			goto pullbytes
+		}
+
+		// Symbols aren't linkable objects, they get their own table which symlinks refer to.
+		// We only insert into the symbol table if we're the top level parser.
+		if p.lnkID == -1 {
+			if err = p.symTbl.add(rng{p.pos + rd, p.pos + rd + blobsz}); err != nil {
+				return
+			}
+		}
+
+		p.ctx = rng{p.pos + rd, p.pos + rd + blobsz}
+		b = p.buf[p.ctx.beg:p.ctx.end]
+		rd += blobsz
+
+	case typeSymlink:
+		// Symlinks are surfaced as the Symbol they refer to.
+		tok = TokenSymbol
+
+		var id, sz int
+		id, sz, needed = p.decodeLong(p.pos + rd)
+		if needed > 0 {
+			goto pullbytes
+		}
+		if id < 0 || id >= len(p.symTbl) {
+			err = p.parserError("Symlink id %d is not valid, %d symbols have been read", id, len(p.symTbl))
+			return
+		}
+		rd += sz
+
+		p.ctx = p.symTbl[id]
+		b = p.buf[p.ctx.beg:p.ctx.end]
+
+	case typeLink:
+		tok = TokenLink
+
+		var sz int
+		num, sz, needed = p.decodeLong(p.pos + rd)
+		if needed > 0 {
+			goto pullbytes
+		}
+		if num < 0 || num >= len(p.lnkTbl) {
+			err = p.parserError("Link id %d is not valid, %d objects have been read", num, len(p.lnkTbl))
+			return
+		}
+		rd += sz
+
+	case typeString, typeClass, typeModule, typeOldModule:
+		switch typ {
+		case typeString:
+			tok = TokenString
+		case typeClass:
+			tok = TokenClass
+		default:
+			// The legacy 'M' type may refer to a class or a module, but it's far more likely to be the latter.
+			tok = TokenModule
+		}
+
+		var blobsz, sz int
+		blobsz, sz, needed = p.decodeLong(p.pos + rd)
+		if needed > 0 {
+			goto pullbytes
+		}
+		if blobsz < 0 {
+			err = p.parserError("Invalid %s length %d", tok, blobsz)
+			return
+		}
 		rd += sz
 
 		if p.pos+rd+blobsz > p.buflen {
@@ -335,23 +729,575 @@ readNum:
 			goto pullbytes
 		}
 
-		b = p.buf[p.pos+rd : p.pos+rd+blobsz]
+		p.ctx = rng{p.pos + rd, p.pos + rd + blobsz}
+		b = p.buf[p.ctx.beg:p.ctx.end]
 		rd += blobsz
 		linkable = true
 
-		// We only insert into the symbol table if we're the top level parser.
-		// if p.lnkID == -1 {
-		if err = p.symTbl.add(rng{p.pos + rd, p.pos + rd + blobsz}); err != nil {
+	case typeRegExp:
+		tok = TokenRegexp
+
+		var blobsz, sz int
+		blobsz, sz, needed = p.decodeLong(p.pos + rd)
+		if needed > 0 {
+			// There's always the option byte after the regexp source.
+			needed += 1
+			goto pullbytes
+		}
+		if blobsz < 0 {
+			err = p.parserError("Invalid %s length %d", tok, blobsz)
 			return
 		}
-		// }
+		rd += sz
+
+		// Regexp source is followed by a single byte of options. See Regexp* constants for valid flags.
+		if p.pos+rd+blobsz+1 > p.buflen {
+			needed = p.pos + rd + blobsz + 1 - p.buflen
+			goto pullbytes
+		}
+
+		p.ctx = rng{p.pos + rd, p.pos + rd + blobsz}
+		b = p.buf[p.ctx.beg:p.ctx.end]
+		rd += blobsz
+		num = int(p.buf[p.pos+rd])
+		rd++
+		linkable = true
+
+	case typeArray, typeHash, typeHashDef:
+		if typ == typeArray {
+			tok = TokenStartArray
+		} else {
+			// Hashes with a default value have a TokenHashDefault after all the pairs, followed by the default value.
+			tok = TokenStartHash
+		}
+
+		var sz int
+		num, sz, needed = p.decodeLong(p.pos + rd)
+		if needed > 0 {
+			goto pullbytes
+		}
+		if num < 0 {
+			err = p.parserError("Invalid %s length %d", tok, num)
+			return
+		}
+		rd += sz
+		linkable = true
+
+	case typeIvar:
+		tok = TokenStartIVar
+
+		// An ivar always wraps a value, so we can safely peek at the type of it.
+		if p.pos+rd+1 > p.buflen {
+			needed = p.pos + rd + 1 - p.buflen
+			goto pullbytes
+		}
+
+		// Ruby registers user defined objects in the link table *after* their instance vars have been read, so
+		// in that case the link table entry is deferred until the ivar context is finished.
+		// Symbols are never registered in the link table, even when they're wrapped in an ivar to carry their
+		// encoding. Ruby does that for every non ASCII symbol, including instance var names and struct members.
+		switch p.buf[p.pos+rd] {
+		case typeUsrDef:
+			lnkDefer = true
+		case typeSymbol:
+			symIVar = true
+		default:
+			linkable = true
+		}
+
+	case typeUsrMarshal:
+		tok = TokenUsrMarshal
+		linkable = true
+
+	case typeData:
+		tok = TokenData
+		linkable = true
+
+	case typeUsrDef:
+		tok = TokenUsrDef
+
+		var symsz int
+		var newSym bool
+		p.cls, symsz, needed, newSym, err = p.decodeSym(p.pos + rd)
+		if err != nil {
+			return
+		} else if needed > 0 {
+			// Data is at least one more byte for the length.
+			needed += 1
+			goto pullbytes
+		}
+		rd += symsz
+
+		var blobsz, sz int
+		blobsz, sz, needed = p.decodeLong(p.pos + rd)
+		if needed > 0 {
+			goto pullbytes
+		}
+		if blobsz < 0 {
+			err = p.parserError("Invalid %s length %d", tok, blobsz)
+			return
+		}
+		rd += sz
+
+		if p.pos+rd+blobsz > p.buflen {
+			needed = p.pos + rd + blobsz - p.buflen
+			goto pullbytes
+		}
+
+		if newSym && p.lnkID == -1 {
+			if err = p.symTbl.add(p.cls); err != nil {
+				return
+			}
+		}
+
+		p.ctx = rng{p.pos + rd, p.pos + rd + blobsz}
+		b = p.buf[p.ctx.beg:p.ctx.end]
+		rd += blobsz
+		linkable = true
+
+	case typeObject, typeStruct:
+		if typ == typeObject {
+			tok = TokenStartObject
+		} else {
+			tok = TokenStartStruct
+		}
+
+		var symsz int
+		var newSym bool
+		p.cls, symsz, needed, newSym, err = p.decodeSym(p.pos + rd)
+		if err != nil {
+			return
+		} else if needed > 0 {
+			// There's at least one more byte for the number of ivars/members.
+			needed += 1
+			goto pullbytes
+		}
+
+		var sz int
+		num, sz, needed = p.decodeLong(p.pos + rd + symsz)
+		if needed > 0 {
+			goto pullbytes
+		}
+		if num < 0 {
+			err = p.parserError("Invalid %s length %d", tok, num)
+			return
+		}
+		rd += symsz + sz
+
+		if newSym && p.lnkID == -1 {
+			if err = p.symTbl.add(p.cls); err != nil {
+				return
+			}
+		}
+
+		b = p.buf[p.cls.beg:p.cls.end]
+		linkable = true
+
+	case typeExtended, typeUsrClass:
+		if typ == typeExtended {
+			tok = TokenExtended
+		} else {
+			tok = TokenUsrClass
+		}
+
+		var symsz int
+		var newSym bool
+		p.cls, symsz, needed, newSym, err = p.decodeSym(p.pos + rd)
+		if err != nil {
+			return
+		} else if needed > 0 {
+			// There's at least one more byte for the wrapped value.
+			needed += 1
+			goto pullbytes
+		}
+		rd += symsz
+
+		if newSym && p.lnkID == -1 {
+			if err = p.symTbl.add(p.cls); err != nil {
+				return
+			}
+		}
+
+		b = p.buf[p.cls.beg:p.cls.end]
+		linkable = true
+
+	default:
+		err = p.parserError("Unhandled type %d encountered", typ)
+		return
 	}
 
-	if linkable {
+	// A Symbol wrapped in an IVar is surfaced as TokenStartIVar, TokenSymbol, its encoding and then TokenEndIVar.
+	if expectSym && tok != TokenSymbol && !symIVar {
+		err = p.parserError("Expected Symbol, got %s", tok)
+		return
+	}
+
+	lnkIdx := -1
+	// Adding link table entries during replay parsing is nonsensical.
+	if linkable && !lnkSkip && p.lnkID == -1 {
+		lnkIdx = len(p.lnkTbl)
 		p.lnkTbl.add(rng{p.pos, p.pos + rd})
 	}
 	p.pos += rd
+	p.cur = tok
+
+	if ivar, st := p.ivarCtx(); ivar != nil {
+		if err = p.trackEnc(ivar, st, tok, b, num); err != nil {
+			return
+		}
+	}
+
+	// Our state is woven through potentially many nested levels of context.
+	// If we start a new context for an array/hash/ivar/whatever, we point its terminal
+	// state at our next one. For example if the top level value was a single depth array,
+	// once the array had finished parsing it would know to transition to parserStateEOF.
+	switch tok {
+	case TokenStartArray:
+		ctx := p.stack.push(ctxTypeArray, num, p.state)
+		ctx.r = lnkIdx
+		if num == 0 {
+			p.state = parserStateArrayEnd
+		} else {
+			p.state = parserStateArray
+		}
+	case TokenStartHash:
+		var ctx *parserCtx
+		if typ == typeHashDef {
+			ctx = p.stack.push(ctxTypeHashDefault, num, p.state)
+		} else {
+			ctx = p.stack.push(ctxTypeHash, num, p.state)
+		}
+		ctx.r = lnkIdx
+		if num > 0 {
+			p.state = parserStateHashKey
+		} else if typ == typeHashDef {
+			p.state = parserStateHashDefault
+		} else {
+			p.state = parserStateHashEnd
+		}
+	case TokenStartIVar:
+		ctx := p.stack.push(ctxTypeIVar, 0, p.state)
+		ctx.r = lnkIdx
+		if lnkDefer {
+			ctx.beg = p.pos - rd
+			ctx.lnkDefer = true
+		}
+		p.state = parserStateIVarInit
+	case TokenUsrMarshal:
+		ctx := p.stack.push(ctxTypeUsrMarshal, 0, p.state)
+		ctx.r = lnkIdx
+		p.state = parserStateUsrMarshalInit
+	case TokenData:
+		// Typed data objects have the same structure as user marshalled objects: a class name Symbol, then a value.
+		ctx := p.stack.push(ctxTypeData, 0, p.state)
+		ctx.r = lnkIdx
+		p.state = parserStateUsrMarshalInit
+	case TokenStartObject:
+		ctx := p.stack.push(ctxTypeObject, num, p.state)
+		ctx.r = lnkIdx
+		if num == 0 {
+			p.state = parserStateObjectEnd
+		} else {
+			p.state = parserStateObjectKey
+		}
+	case TokenStartStruct:
+		ctx := p.stack.push(ctxTypeStruct, num, p.state)
+		ctx.r = lnkIdx
+		if num == 0 {
+			p.state = parserStateStructEnd
+		} else {
+			p.state = parserStateStructKey
+		}
+	case TokenExtended, TokenUsrClass:
+		ctx := p.stack.push(ctxTypeWrapped, 0, p.state)
+		ctx.r = lnkIdx
+		p.state = parserStateWrappedVal
+	}
+
+	return
+}
+
+// ivarCtx returns the IVar context that the value just read belongs to, along with the state that IVar is in.
+// The value an IVar wraps may itself be wrapped in a user class and/or extended, like I C :Foo "..." :E T, in which
+// case the innermost value is what the instance vars belong to.
+func (p *Parser) ivarCtx() (*parserCtx, parserState) {
+	cur := p.stack.cur()
+	if cur == nil {
+		return nil, 0
+	}
+	if cur.typ == ctxTypeIVar {
+		return cur, p.state
+	}
+	if cur.typ != ctxTypeWrapped {
+		return nil, 0
+	}
+
+	i := len(p.stack) - 1
+	for i > 0 && p.stack[i-1].typ == ctxTypeWrapped {
+		i--
+	}
+	if i == 0 || p.stack[i-1].typ != ctxTypeIVar || p.stack[i].next != parserStateIVarLen {
+		return nil, 0
+	}
+	return &p.stack[i-1], parserStateIVarLen
+}
+
+// trackEnc watches the values read directly in an IVar context, to find the encoding declared for the text it wraps.
+func (p *Parser) trackEnc(cur *parserCtx, st parserState, tok Token, b []byte, num int) error {
+	switch st {
+	case parserStateIVarLen:
+		// We just read the value that the instance vars belong to.
+		switch tok {
+		case TokenString, TokenRegexp, TokenSymbol, TokenUsrDef:
+			cur.val, cur.txt = p.ctx, true
+		}
+	case parserStateIVarValue:
+		// We just read an instance var name.
+		cur.encKey = cur.txt && (string(b) == "E" || string(b) == "encoding")
+	default:
+		// We just read an instance var value.
+		if !cur.encKey {
+			return nil
+		}
+		cur.encKey = false
+
+		switch tok {
+		case TokenTrue:
+			cur.enc = EncodingUTF8
+		case TokenFalse:
+			cur.enc = EncodingASCII
+		case TokenString:
+			cur.enc = string(b)
+		case TokenLink:
+			// Ruby only writes the name of each encoding once, subsequent uses are links to that String.
+			r := p.lnkTbl[num]
+			if p.buf[r.beg] != typeString {
+				return p.parserError("Encoding link id %d does not refer to a String", num)
+			}
+			n, sz, _ := p.decodeLong(r.beg + 1)
+			cur.enc = string(p.buf[r.beg+1+sz : r.beg+1+sz+n])
+		default:
+			return p.parserError("Invalid encoding value %s", tok)
+		}
+	}
+	return nil
+}
+
+// Encoding returns the name of the Ruby encoding of the String, Regexp, Symbol or user defined object data wrapped by
+// the IVar that has just ended. Text that has no encoding instance var is binary, so EncodingBinary is returned for it.
+// Returns an error if called for any token other than TokenEndIVar.
+func (p *Parser) Encoding() (string, error) {
+	if p.cur != TokenEndIVar {
+		return "", errors.Errorf("Encoding() called on incorrect token %q", p.cur)
+	}
+	if !p.txt {
+		return "", errors.New("Encoding() called on IVar that does not wrap text")
+	}
+	if p.enc == "" {
+		return EncodingBinary, nil
+	}
+	return p.enc, nil
+}
+
+// Text returns the String, Regexp source, Symbol or user defined object data wrapped by the IVar that has just ended.
+// The text may be wrapped in a user class or extended with modules.
+// If a Transcoder has been set with SetTranscoder, text that is not UTF-8, US-ASCII or binary is converted to UTF-8.
+// Otherwise the returned slice is a reference to the internal read buffer used by this Parser, it is only valid until
+// the next call to Reset().
+// Returns an error if called for any token other than TokenEndIVar.
+func (p *Parser) Text() ([]byte, error) {
+	if p.cur != TokenEndIVar {
+		return nil, errors.Errorf("Text() called on incorrect token %q", p.cur)
+	}
+	if !p.txt {
+		return nil, errors.New("Text() called on IVar that does not wrap text")
+	}
+
+	b := p.buf[p.ctx.beg:p.ctx.end]
+	switch p.enc {
+	case "", EncodingUTF8, EncodingASCII, EncodingBinary:
+		return b, nil
+	}
+	if p.tc == nil {
+		return b, nil
+	}
+	return p.tc.Transcode(b, p.enc)
+}
+
+// Float decodes the value of the current Float token.
+// Returns an error if called for any other type of token.
+func (p *Parser) Float() (float64, error) {
+	if p.cur != TokenFloat {
+		return 0, errors.Errorf("Float() called on incorrect token %q", p.cur)
+	}
+
+	b := p.buf[p.ctx.beg:p.ctx.end]
+	switch string(b) {
+	case "nan":
+		return math.NaN(), nil
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+
+	// Legacy Marshal streams may have extra mantissa bytes after a NUL terminated decimal representation.
+	var mant []byte
+	if i := bytes.IndexByte(b, 0); i > -1 {
+		b, mant = b[:i], b[i:]
+	}
+
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse float")
+	}
+	return loadMantissa(f, mant), nil
+}
+
+// loadMantissa is a port of the Ruby function of the same name. It applies the extra mantissa bits in a legacy
+// encoded float to the value parsed from its decimal representation.
+func loadMantissa(d float64, buf []byte) float64 {
+	l := len(buf) - 1
+	if l <= 0 || buf[0] != 0 {
+		return d
+	}
+	buf = buf[1:]
+
+	neg := d < 0
+	frac, e := math.Frexp(math.Abs(d))
+	d, _ = math.Modf(math.Ldexp(frac, floatDecimalMant))
+
+	dig := 0
+	for l > 0 {
+		n := l
+		if n > floatMantBits/8 {
+			n = floatMantBits / 8
+		}
+
+		var m uint64
+		for i := 0; i < n; i++ {
+			m = m<<8 | uint64(buf[i])
+		}
+		buf = buf[n:]
+
+		dig -= 8 * n
+		d += math.Ldexp(float64(m), dig)
+		l -= floatMantBits / 8
+	}
+
+	d = math.Ldexp(d, e-floatDecimalMant)
+	if neg {
+		d = -d
+	}
+	return d
+}
+
+// Bignum decodes the magnitude and sign of the current Bignum token into the provided big.Int.
+// The words already allocated in n are reused where possible.
+// Returns an error if called for any other type of token.
+func (p *Parser) Bignum(n *big.Int) error {
+	if p.cur != TokenBignum {
+		return errors.Errorf("Bignum() called on incorrect token %q", p.cur)
+	}
+
+	// Magnitude is stored little-endian, so we can pack it straight into Words.
+	wordsz := (p.ctx.end - p.ctx.beg + _S - 1) / _S
+	bits := n.Bits()
+	if cap(bits) < wordsz {
+		bits = make([]big.Word, wordsz)
+	} else {
+		bits = bits[0:wordsz]
+	}
+
+	var d big.Word
+	k, s := 0, uint(0)
+	for pos := p.ctx.beg; pos < p.ctx.end; pos++ {
+		d |= big.Word(p.buf[pos]) << s
+		if s += 8; s == _S*8 {
+			bits[k] = d
+			k++
+			s = 0
+			d = 0
+		}
+	}
+	if k < wordsz {
+		bits[k] = d
+	}
+
+	n.SetBits(bits)
+	if p.bnumsign == '-' {
+		n.Neg(n)
+	}
+	return nil
+}
+
+// endCtx pops the current context off the stack, patching the final position of the value into the link table.
+// Returns the state to transition to.
+func (p *Parser) endCtx() parserState {
+	cur := p.stack.cur()
+	if cur.r > -1 {
+		p.lnkTbl[cur.r].end = p.pos
+	} else if cur.lnkDefer && p.lnkID == -1 {
+		p.lnkTbl.add(rng{cur.beg, p.pos})
+	}
+	return p.stack.pop()
+}
 
+// ClassName returns the class name of the current TokenUsrDef, TokenStartObject, TokenStartStruct or TokenUsrClass
+// token, or the module name of the current TokenExtended token.
+// Non ASCII class and module names, which Ruby wraps in an IVar along with their encoding, are not supported and fail
+// to parse.
+// NOTE: the returned slice is a reference to the internal read buffer used by this Parser, it is only valid until
+// the next call to Reset().
+func (p *Parser) ClassName() ([]byte, error) {
+	switch p.cur {
+	case TokenUsrDef, TokenStartObject, TokenStartStruct, TokenExtended, TokenUsrClass:
+		return p.buf[p.cls.beg:p.cls.end], nil
+	}
+	return nil, errors.Errorf("ClassName() called on incorrect token %q", p.cur)
+}
+
+// decodeSym looks at a Symbol or Symlink in the read buffer at given pos and decodes it.
+// It will return the range of the symbol name in the read buffer and the number of bytes the Symbol/Symlink occupies,
+// or the number of extra bytes it needs available in the read buffer to complete decoding.
+// If the symbol has not been seen before isNew is set, and the caller is responsible for adding it to the symTbl.
+func (p *Parser) decodeSym(pos int) (r rng, sz, need int, isNew bool, err error) {
+	// Symbols and symlinks are always at least 2 bytes.
+	if pos+2 > p.buflen {
+		need = pos + 2 - p.buflen
+		return
+	}
+
+	var n, lsz int
+	if n, lsz, need = p.decodeLong(pos + 1); need > 0 {
+		return
+	}
+
+	switch p.buf[pos] {
+	case typeSymbol:
+		if n < 0 {
+			err = p.parserError("Invalid TokenSymbol length %d", n)
+			return
+		}
+		r = rng{pos + 1 + lsz, pos + 1 + lsz + n}
+		if r.end > p.buflen {
+			need = r.end - p.buflen
+			return
+		}
+		sz = 1 + lsz + n
+		isNew = true
+	case typeSymlink:
+		if n < 0 || n >= len(p.symTbl) {
+			err = p.parserError("Symlink id %d is not valid, %d symbols have been read", n, len(p.symTbl))
+			return
+		}
+		r = p.symTbl[n]
+		sz = 1 + lsz
+	case typeIvar:
+		err = p.parserError("IVar wrapped Symbol not supported as class or module name")
+	default:
+		err = p.parserError("Expected Symbol, got type %d", p.buf[pos])
+	}
 	return
 }
 
@@ -402,6 +1348,8 @@ func (p *Parser) decodeLong(pos int) (n, sz, need int) {
 
 		n |= int(p.buf[pos+1+i]) << uint(8*i)
 	}
+	// Account for the leading byte that holds the number of bytes that follow.
+	sz++
 
 	return
 }
@@ -426,6 +1374,8 @@ const (
 	parserStateHashKey
 	parserStateHashValue
 	parserStateHashEnd
+	parserStateHashDefault
+	parserStateHashDefaultVal
 	parserStateIVarInit
 	parserStateIVarLen
 	parserStateIVarKey
@@ -434,6 +1384,14 @@ const (
 	parserStateUsrMarshalInit
 	parserStateUsrMarshalVal
 	parserStateUsrMarshalEnd
+	parserStateObjectKey
+	parserStateObjectValue
+	parserStateObjectEnd
+	parserStateStructKey
+	parserStateStructValue
+	parserStateStructEnd
+	parserStateWrappedVal
+	parserStateWrappedEnd
 	parserStateEOF
 )
 
@@ -444,16 +1402,31 @@ type parserCtx struct {
 	typ  uint8
 	sz   int
 	pos  int
-	r    *rng        // when this context is finished, r (pointing into lnkTbl) is updated with final location
+	r    int         // when this context is finished, lnkTbl[r] is updated with final location (-1 if none)
 	next parserState // Next state transition when we're done with this stack item
+
+	// when this context is finished, if lnkDefer is set a new entry is added to lnkTbl, starting from beg.
+	lnkDefer bool
+	beg      int
+
+	// for ivars wrapping text (a String, Regexp, Symbol or user defined object), its range and declared encoding.
+	txt    bool
+	val    rng
+	enc    string
+	encKey bool // set if the next ivar value is the encoding
 }
 
 // The valid context types
 const (
 	ctxTypeArray = iota
 	ctxTypeHash
+	ctxTypeHashDefault
 	ctxTypeIVar
 	ctxTypeUsrMarshal
+	ctxTypeObject
+	ctxTypeStruct
+	ctxTypeWrapped
+	ctxTypeData
 	ctxTypeReplay
 )
 
@@ -482,7 +1455,7 @@ func (stk *parserStack) push(typ uint8, sz int, next parserState) *parserCtx {
 		*stk = newStk[0:l]
 	}
 
-	*stk = append(*stk, parserCtx{typ: typ, sz: sz, r: nil, next: next})
+	*stk = append(*stk, parserCtx{typ: typ, sz: sz, r: -1, next: next})
 	return &(*stk)[l]
 }
 
@@ -0,0 +1,92 @@
+package rmarsh
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParserRngTblGrow(t *testing.T) {
+	var tbl rngTbl
+
+	tbl.add(rng{})
+	if len(tbl) != 1 {
+		t.Fatalf("len(tbl) != 1 == %d", len(tbl))
+	}
+	if cap(tbl) != rngTblInitSz {
+		t.Fatalf("cap(tbl) != rngTblInitSz == %d", cap(tbl))
+	}
+
+	for i := 0; i < rngTblInitSz; i++ {
+		tbl.add(rng{})
+	}
+
+	if cap(tbl) != rngTblInitSz*2 {
+		t.Fatalf("cap(tbl) != rngTblInitSz*2 == %d", cap(tbl))
+	}
+}
+
+func TestParserReset(t *testing.T) {
+	var b1, b2 bytes.Buffer
+	p := NewParser(&b1)
+
+	p.Reset(&b2)
+	if p.r != &b2 {
+		t.Fatalf("p.r == %v, not %v", p.r, b2)
+	}
+
+	p.Reset(nil)
+	if p.r != &b2 {
+		t.Fatalf("p.r == %v, not %v", p.r, b2)
+	}
+}
+
+func TestParserLnkTblContainers(t *testing.T) {
+	// [[1.2], {}]
+	raw := []byte{0x04, 0x08, '[', 0x07, '[', 0x06, 'f', 0x08, '1', '.', '2', '{', 0x00}
+	p := NewParser(bytes.NewReader(raw))
+	for {
+		tok, _, _, err := p.Read()
+		if err != nil {
+			t.Fatal(err)
+		} else if tok == TokenEOF {
+			break
+		}
+	}
+
+	exp := []rng{{2, 13}, {4, 11}, {6, 11}, {11, 13}}
+	if len(p.lnkTbl) != len(exp) {
+		t.Fatalf("len(p.lnkTbl) = %d, expected %d", len(p.lnkTbl), len(exp))
+	}
+	for i, r := range exp {
+		if p.lnkTbl[i] != r {
+			t.Errorf("p.lnkTbl[%d] = %v, expected %v", i, p.lnkTbl[i], r)
+		}
+	}
+}
+
+func TestParserReplayRecursive(t *testing.T) {
+	p := Parser{lnkID: 1}
+	if _, err := p.Replay(1); err.Error() != "Object ID 1 is already being replayed by this Parser" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+
+	p2 := Parser{parent: &p, lnkID: 123}
+	if _, err := p2.Replay(1); err.Error() != "Object ID 1 is already being replayed by this Parser" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+}
+
+func TestParserReplayInProgress(t *testing.T) {
+	// [[], nil]
+	raw := []byte{0x04, 0x08, '[', 0x07, '[', 0x00, '0'}
+	p := NewParser(bytes.NewReader(raw))
+	if tok, _, _, err := p.Read(); err != nil || tok != TokenStartArray {
+		t.Fatalf("Unexpected tok %s err %s", tok, err)
+	}
+	if _, err := p.Replay(0); err == nil || err.Error() != "Object ID 0 is currently being parsed and cannot be replayed" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+	if _, err := p.Replay(1); err == nil || err.Error() != "Object ID 1 not valid" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
-	"strconv"
+	"math"
+	"math/big"
 	"testing"
 
 	"github.com/samcday/rmarsh"
+	"golang.org/x/text/encoding/unicode"
 )
 
 var curRaw []byte
@@ -158,10 +160,32 @@ func BenchmarkParserFixnumMultiByte(b *testing.B) {
 	}
 }
 
+func TestParserMultiByteLongs(t *testing.T) {
+	// Fixnums and lengths that need more than one byte must be fully consumed before the next value is read.
+	raw := []byte{0x04, 0x08, 'I', '"', 0x01, 0xC8}
+	raw = append(raw, bytes.Repeat([]byte{'a'}, 200)...)
+	raw = append(raw, 0x07, ':', 0x07, '@', 'a', 'i', 0x02, 0xEF, 0xBE, ':', 0x07, '@', 'b', 'T')
+
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	if b, _ := expectToken(t, p, rmarsh.TokenString); !bytes.Equal(b, bytes.Repeat([]byte{'a'}, 200)) {
+		t.Errorf("String = %q, expected 200 a's", b)
+	}
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	if _, n := expectToken(t, p, rmarsh.TokenFixnum); n != 0xBEEF {
+		t.Errorf("Fixnum = %#.2X, expected 0xBEEF", n)
+	}
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
 func TestParserFloat(t *testing.T) {
 	p := parseFromRuby(t, "123.321")
-	b, _ := expectToken(t, p, rmarsh.TokenFloat)
-	if n, err := strconv.ParseFloat(string(b), 64); err != nil {
+	expectToken(t, p, rmarsh.TokenFloat)
+	if n, err := p.Float(); err != nil {
 		t.Errorf("p.Float() err %s", err)
 	} else if n != 123.321 {
 		t.Errorf("p.Float() = %f, expected 123.321", n)
@@ -169,6 +193,50 @@ func TestParserFloat(t *testing.T) {
 	expectToken(t, p, rmarsh.TokenEOF)
 }
 
+func TestParserFloatSpecial(t *testing.T) {
+	for expr, check := range map[string]func(float64) bool{
+		"1.0/0":  func(f float64) bool { return math.IsInf(f, 1) },
+		"-1.0/0": func(f float64) bool { return math.IsInf(f, -1) },
+		"0.0/0":  math.IsNaN,
+		"-0.0":   func(f float64) bool { return f == 0 && math.Signbit(f) },
+	} {
+		p := parseFromRuby(t, expr)
+		expectToken(t, p, rmarsh.TokenFloat)
+		if n, err := p.Float(); err != nil {
+			t.Errorf("%s: p.Float() err %s", expr, err)
+		} else if !check(n) {
+			t.Errorf("%s: p.Float() = %f", expr, n)
+		}
+		expectToken(t, p, rmarsh.TokenEOF)
+	}
+}
+
+func TestParserFloatLegacyMantissa(t *testing.T) {
+	// Older Ruby versions wrote extra mantissa bytes after a NUL terminated decimal representation.
+	for str, expected := range map[string]float64{
+		"0.10000000000001\x00\x99\x9a":  0.1,
+		"-0.33333333333334\x00\x55\x55": -1.0 / 3,
+	} {
+		raw := append([]byte{0x04, 0x08, 'f', byte(len(str) + 5)}, str...)
+		p := rmarsh.NewParser(bytes.NewReader(raw))
+		expectToken(t, p, rmarsh.TokenFloat)
+		if n, err := p.Float(); err != nil {
+			t.Errorf("p.Float() err %s", err)
+		} else if n != expected {
+			t.Errorf("p.Float() = %v, expected %v", n, expected)
+		}
+		expectToken(t, p, rmarsh.TokenEOF)
+	}
+}
+
+func TestParserFloatIncorrectToken(t *testing.T) {
+	p := parseFromRuby(t, "123")
+	expectToken(t, p, rmarsh.TokenFixnum)
+	if _, err := p.Float(); err == nil || err.Error() != `Float() called on incorrect token "TokenFixnum"` {
+		t.Errorf("Unexpected err %v", err)
+	}
+}
+
 func BenchmarkParserFloatSingleByte(b *testing.B) {
 	buf := newCyclicReader(rbEncode(b, "1.to_f"))
 	p := rmarsh.NewParser(buf)
@@ -199,6 +267,58 @@ func BenchmarkParserFloatMultiByte(b *testing.B) {
 	}
 }
 
+func TestParserBignum(t *testing.T) {
+	tests := []string{
+		"DEADCAFEBEEF",
+		"-DEADCAFEBEEF",
+		"DEADCAFEBEEFEEBAE",
+		"-DEADCAFEBEEFEEBAE",
+	}
+
+	for _, str := range tests {
+		var exp, n big.Int
+		exp.SetString(str, 16)
+
+		p := parseFromRuby(t, fmt.Sprintf("0x%s", str))
+		_, sign := expectToken(t, p, rmarsh.TokenBignum)
+		if sign != exp.Sign() {
+			t.Errorf("Bignum sign %d != %d", sign, exp.Sign())
+		}
+		if err := p.Bignum(&n); err != nil {
+			t.Fatalf("p.Bignum() err %s", err)
+		} else if n.Cmp(&exp) != 0 {
+			t.Errorf("p.Bignum() = %s, expected %s", n.Text(16), exp.Text(16))
+		}
+		expectToken(t, p, rmarsh.TokenEOF)
+	}
+
+	p := parseFromRuby(t, "true")
+	expectToken(t, p, rmarsh.TokenTrue)
+	var n big.Int
+	if err := p.Bignum(&n); err == nil || err.Error() != `Bignum() called on incorrect token "TokenTrue"` {
+		t.Errorf("p.Bignum() unexpected err %s", err)
+	}
+}
+
+func BenchmarkParserBignum(b *testing.B) {
+	buf := newCyclicReader(rbEncode(b, "0xDEADCAFEBEEF"))
+	p := rmarsh.NewParser(buf)
+	var n big.Int
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenBignum {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+		if err := p.Bignum(&n); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestParserSymbol(t *testing.T) {
 	p := parseFromRuby(t, ":test")
 	b, _ := expectToken(t, p, rmarsh.TokenSymbol)
@@ -244,3 +364,1046 @@ func BenchmarkParserSymbolMultiByte(b *testing.B) {
 		}
 	}
 }
+
+func TestParserString(t *testing.T) {
+	// We generate this string in a convoluted way so it has no encoding (and thus no IVar)
+	p := parseFromRuby(t, `"test".force_encoding("ASCII-8BIT")`)
+	b, _ := expectToken(t, p, rmarsh.TokenString)
+	if str := string(b); str != "test" {
+		t.Errorf("String = %s, expected test", str)
+	}
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func BenchmarkParserString(b *testing.B) {
+	buf := newCyclicReader(rbEncode(b, `"test".force_encoding("ASCII-8BIT")`))
+	p := rmarsh.NewParser(buf)
+	exp := []byte("test")
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		if tok, data, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenString {
+			b.Fatalf("Unexpected token %s", tok)
+		} else if !bytes.Equal(data, exp) {
+			b.Fatalf("%s != test", data)
+		}
+	}
+}
+
+func TestParserIVarString(t *testing.T) {
+	p := parseFromRuby(t, `"test"`)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	b, _ := expectToken(t, p, rmarsh.TokenString)
+	if str := string(b); str != "test" {
+		t.Errorf("String = %s, expected test", str)
+	}
+
+	_, n := expectToken(t, p, rmarsh.TokenIVarProps)
+	if n != 1 {
+		t.Errorf("IVar len = %d, expected 1", n)
+	}
+
+	b, _ = expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "E" {
+		t.Errorf("Symbol = %s, expected E", str)
+	}
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserIVarStringEncoding(t *testing.T) {
+	p := parseFromRuby(t, `"test".force_encoding("SHIFT_JIS")`)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	b, _ := expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "encoding" {
+		t.Errorf("Symbol = %s, expected encoding", str)
+	}
+	b, _ = expectToken(t, p, rmarsh.TokenString)
+	if str := string(b); str != "Shift_JIS" {
+		t.Errorf("String = %s, expected Shift_JIS", str)
+	}
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserIVarInvalidKey(t *testing.T) {
+	raw := []byte{0x04, 0x08, 'I', '"', 0x06, 'a', 0x06, 'i', 0x06, 'T'}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	if _, _, _, err := p.Read(); err == nil || err.Error() != "Expected Symbol, got TokenFixnum" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+}
+
+func expectText(t *testing.T, p *rmarsh.Parser, enc, text string) {
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	if e, err := p.Encoding(); err != nil {
+		t.Fatalf("p.Encoding() err %s", err)
+	} else if e != enc {
+		t.Errorf("p.Encoding() = %s, expected %s", e, enc)
+	}
+	if b, err := p.Text(); err != nil {
+		t.Fatalf("p.Text() err %s", err)
+	} else if str := string(b); str != text {
+		t.Errorf("p.Text() = %q, expected %q", str, text)
+	}
+}
+
+func TestParserText(t *testing.T) {
+	p := parseFromRuby(t, `["test", "test".force_encoding("US-ASCII"), :"f\u00f6\u00f6"]`)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	for _, enc := range []struct {
+		name string
+		tok  rmarsh.Token
+	}{{rmarsh.EncodingUTF8, rmarsh.TokenTrue}, {rmarsh.EncodingASCII, rmarsh.TokenFalse}} {
+		expectToken(t, p, rmarsh.TokenStartIVar)
+		expectToken(t, p, rmarsh.TokenString)
+		expectToken(t, p, rmarsh.TokenIVarProps)
+		expectToken(t, p, rmarsh.TokenSymbol)
+		expectToken(t, p, enc.tok)
+		expectText(t, p, enc.name, "test")
+	}
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectText(t, p, rmarsh.EncodingUTF8, "f\u00f6\u00f6")
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserTextTranscode(t *testing.T) {
+	p := parseFromRuby(t, `"\x82\xa0".force_encoding("Shift_JIS")`)
+	p.SetTranscoder(rmarsh.DefaultTranscoder)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenString)
+	expectText(t, p, "Shift_JIS", "\u3042")
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserTextTranscodeLink(t *testing.T) {
+	// Ruby writes each encoding name once, the second string links to it.
+	raw := []byte("\x04\x08[\x07I\"\x07\x82\xa0\x06:\x0dencoding\"\x0eShift_JISI\"\x07\x82\xa2\x06;\x00@\x07")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	p.SetTranscoder(rmarsh.DefaultTranscoder)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	for i, text := range []string{"\u3042", "\u3044"} {
+		expectToken(t, p, rmarsh.TokenStartIVar)
+		expectToken(t, p, rmarsh.TokenString)
+		expectToken(t, p, rmarsh.TokenIVarProps)
+		expectToken(t, p, rmarsh.TokenSymbol)
+		if i == 0 {
+			expectToken(t, p, rmarsh.TokenString)
+		} else {
+			expectToken(t, p, rmarsh.TokenLink)
+		}
+		expectText(t, p, "Shift_JIS", text)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserTextTranscodeInvalid(t *testing.T) {
+	raw := []byte("\x04\x08I\"\x06\x82\x06:\x0dencoding\"\x0eShift_JIS")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	p.SetTranscoder(rmarsh.DefaultTranscoder)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	_, err := p.Text()
+	if encErr, ok := err.(rmarsh.InvalidEncodingError); !ok || encErr.Encoding != "Shift_JIS" {
+		t.Fatalf("Unexpected err %v", err)
+	}
+}
+
+func TestParserTextWrapped(t *testing.T) {
+	// Ruby writes the encoding of a String subclass outside of the user class.
+	raw := []byte("\x04\x08IC:\x08Foo\"\x08abc\x06:\x06ET")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenUsrClass)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectText(t, p, rmarsh.EncodingUTF8, "abc")
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	raw = []byte("\x04\x08Ie:\x08ModC:\x08Foo\"\x07\x82\xa0\x06:\x0dencoding\"\x0eShift_JIS")
+	p = rmarsh.NewParser(bytes.NewReader(raw))
+	p.SetTranscoder(rmarsh.DefaultTranscoder)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenExtended)
+	expectToken(t, p, rmarsh.TokenUsrClass)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenString)
+	expectText(t, p, "Shift_JIS", "\u3042")
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserTextUsrDef(t *testing.T) {
+	raw := []byte("\x04\x08Iu:\x08Foo\x08abc\x06:\x06EF")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenUsrDef)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenFalse)
+	expectText(t, p, rmarsh.EncodingASCII, "abc")
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserTextInvalidEncoding(t *testing.T) {
+	// A link to something other than a String can't be an encoding name.
+	raw := []byte("\x04\x08[\x07[\x00I\"\x06a\x06:\x0dencoding@\x06")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	if _, _, _, err := p.Read(); err == nil || err.Error() != "Encoding link id 1 does not refer to a String" {
+		t.Fatalf("Unexpected err %v", err)
+	}
+
+	raw = []byte("\x04\x08I\"\x06a\x06:\x06E0")
+	p = rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	if _, _, _, err := p.Read(); err == nil || err.Error() != "Invalid encoding value TokenNil" {
+		t.Fatalf("Unexpected err %v", err)
+	}
+}
+
+func TestParserTextTranscodeReplacementChar(t *testing.T) {
+	// U+FFFD is only an error if it wasn't in the source text.
+	tc := rmarsh.TextTranscoder{"UTF-16LE": unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)}
+	for src, valid := range map[string]bool{"a\x00\xfd\xff": true, "a\x00\x00\xd8": false} {
+		raw := []byte("\x04\x08I\"\x09" + src + "\x06:\x0dencoding\"\x0dUTF-16LE")
+		p := rmarsh.NewParser(bytes.NewReader(raw))
+		p.SetTranscoder(tc)
+		expectToken(t, p, rmarsh.TokenStartIVar)
+		expectToken(t, p, rmarsh.TokenString)
+		expectToken(t, p, rmarsh.TokenIVarProps)
+		expectToken(t, p, rmarsh.TokenSymbol)
+		expectToken(t, p, rmarsh.TokenString)
+		expectToken(t, p, rmarsh.TokenEndIVar)
+		b, err := p.Text()
+		if valid && (err != nil || string(b) != "a\ufffd") {
+			t.Errorf("p.Text() = %q, %v, expected \"a\ufffd\"", b, err)
+		} else if _, ok := err.(rmarsh.InvalidEncodingError); !valid && !ok {
+			t.Errorf("Unexpected err %v", err)
+		}
+	}
+}
+
+func TestParserTextNoEncoding(t *testing.T) {
+	// Text with instance vars but no encoding is binary.
+	raw := []byte("\x04\x08I\"\x06a\x06:\x07@aT")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectText(t, p, rmarsh.EncodingBinary, "a")
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func BenchmarkParserIVarString(b *testing.B) {
+	buf := newCyclicReader(rbEncode(b, `"test"`))
+	p := rmarsh.NewParser(buf)
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		for _, exp := range []rmarsh.Token{rmarsh.TokenStartIVar, rmarsh.TokenString, rmarsh.TokenIVarProps, rmarsh.TokenSymbol, rmarsh.TokenTrue, rmarsh.TokenEndIVar} {
+			if tok, _, _, err := p.Read(); err != nil {
+				b.Fatal(err)
+			} else if tok != exp {
+				b.Fatalf("Unexpected token %s", tok)
+			}
+		}
+	}
+}
+
+func TestParserEmptyArray(t *testing.T) {
+	p := parseFromRuby(t, "[]")
+	_, n := expectToken(t, p, rmarsh.TokenStartArray)
+	if n != 0 {
+		t.Errorf("Array len = %d, expected 0", n)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func BenchmarkParserEmptyArray(b *testing.B) {
+	buf := newCyclicReader(rbEncode(b, "[]"))
+	p := rmarsh.NewParser(buf)
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenStartArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenEndArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+	}
+}
+
+func TestParserArray(t *testing.T) {
+	p := parseFromRuby(t, "[nil, true, 123]")
+	_, n := expectToken(t, p, rmarsh.TokenStartArray)
+	if n != 3 {
+		t.Errorf("Array len = %d, expected 3", n)
+	}
+	expectToken(t, p, rmarsh.TokenNil)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserNestedArray(t *testing.T) {
+	p := parseFromRuby(t, "[[]]")
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p = parseFromRuby(t, "[[], [1]]")
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func BenchmarkParserLargeArray(b *testing.B) {
+	// Large enough that the array length is encoded with multiple bytes.
+	buf := newCyclicReader(rbEncode(b, "[nil] * 1000"))
+	p := rmarsh.NewParser(buf)
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		if tok, _, n, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenStartArray || n != 1000 {
+			b.Fatalf("Unexpected token %s with len %d", tok, n)
+		}
+		for j := 0; j < 1000; j++ {
+			if tok, _, _, err := p.Read(); err != nil {
+				b.Fatal(err)
+			} else if tok != rmarsh.TokenNil {
+				b.Fatalf("Unexpected token %s", tok)
+			}
+		}
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenEndArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+	}
+}
+
+func TestParserHash(t *testing.T) {
+	p := parseFromRuby(t, "{}")
+	expectToken(t, p, rmarsh.TokenStartHash)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p = parseFromRuby(t, "{1 => 123}")
+	_, n := expectToken(t, p, rmarsh.TokenStartHash)
+	if n != 1 {
+		t.Errorf("Hash len = %d, expected 1", n)
+	}
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p = parseFromRuby(t, "{{} => [nil]}")
+	expectToken(t, p, rmarsh.TokenStartHash)
+	expectToken(t, p, rmarsh.TokenStartHash)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenNil)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserIVarArray(t *testing.T) {
+	p := parseFromRuby(t, `[].tap{|v|v.instance_variable_set(:@test, 123)}`)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	_, n := expectToken(t, p, rmarsh.TokenIVarProps)
+	if n != 1 {
+		t.Errorf("IVar len = %d, expected 1", n)
+	}
+	b, _ := expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "@test" {
+		t.Errorf("Symbol = %s, expected @test", str)
+	}
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserSymlink(t *testing.T) {
+	p := parseFromRuby(t, "[:test, :test]")
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	b, _ := expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "test" {
+		t.Errorf("Symbol = %s, expected test", str)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserSymlinkInvalid(t *testing.T) {
+	raw := []byte{0x04, 0x08, '[', 0x07, ':', 0x06, 'a', ';', 0x06}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	_, _, _, err := p.Read()
+	if perr, ok := err.(rmarsh.ParserError); !ok || perr.Error() != "Symlink id 1 is not valid, 1 symbols have been read" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+}
+
+func BenchmarkParserSymlink(b *testing.B) {
+	buf := newCyclicReader(rbEncode(b, "[:test, :test]"))
+	p := rmarsh.NewParser(buf)
+	exp := []byte("test")
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenStartArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenSymbol {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+		if tok, data, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenSymbol {
+			b.Fatalf("Unexpected token %s", tok)
+		} else if !bytes.Equal(data, exp) {
+			b.Fatalf("%s != test", data)
+		}
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenEndArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+	}
+}
+
+func TestParserLink(t *testing.T) {
+	p := parseFromRuby(t, `a = 1.2; [:foo, a, a]`)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenFloat)
+	_, id := expectToken(t, p, rmarsh.TokenLink)
+	if id != 1 {
+		t.Errorf("Link id = %d, expected 1", id)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserNegativeLength(t *testing.T) {
+	for raw, msg := range map[string]string{
+		"\x04\x08\"\xfa":      "Invalid TokenString length -1",
+		"\x04\x08l+\xfa":      "Invalid TokenBignum length -1",
+		"\x04\x08/\xfa\x00":   "Invalid TokenRegexp length -1",
+		"\x04\x08c\xfa":       "Invalid TokenClass length -1",
+		"\x04\x08f\xfa\x00":   "Invalid TokenFloat length -1",
+		"\x04\x08:\xfa\x00":   "Invalid TokenSymbol length -1",
+		"\x04\x08u:\x06A\xfa": "Invalid TokenUsrDef length -1",
+		"\x04\x08o:\xfa\x00":  "Invalid TokenSymbol length -1",
+	} {
+		p := rmarsh.NewParser(bytes.NewReader([]byte(raw)))
+		_, _, _, err := p.Read()
+		if perr, ok := err.(rmarsh.ParserError); !ok || perr.Error() != msg {
+			t.Errorf("Unexpected err %v for %q, expected %s", err, raw, msg)
+		}
+	}
+}
+
+func TestParserLinkInvalid(t *testing.T) {
+	raw := []byte{0x04, 0x08, '[', 0x06, '@', 0x06}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	_, _, _, err := p.Read()
+	if perr, ok := err.(rmarsh.ParserError); !ok || perr.Error() != "Link id 1 is not valid, 1 objects have been read" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+}
+
+func TestParserMultiByteLinks(t *testing.T) {
+	// An array of 125 strings and 124 symbols, followed by a link and a symlink to the 124th of each.
+	// The array length and both ids need more than one byte.
+	raw := []byte{0x04, 0x08, '[', 0x01, 0xFB}
+	for i := 0; i < 125; i++ {
+		raw = append(raw, '"', 0x00)
+	}
+	for i := 0; i < 124; i++ {
+		raw = append(raw, ':', 0x07, byte('a'+i/26), byte('a'+i%26))
+	}
+	raw = append(raw, '@', 0x01, 0x7B, ';', 0x01, 0x7B)
+
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	if _, n := expectToken(t, p, rmarsh.TokenStartArray); n != 251 {
+		t.Errorf("Array length = %d, expected 251", n)
+	}
+	for i := 0; i < 125; i++ {
+		expectToken(t, p, rmarsh.TokenString)
+	}
+	for i := 0; i < 124; i++ {
+		expectToken(t, p, rmarsh.TokenSymbol)
+	}
+	if _, id := expectToken(t, p, rmarsh.TokenLink); id != 123 {
+		t.Errorf("Link id = %d, expected 123", id)
+	}
+	if b, _ := expectToken(t, p, rmarsh.TokenSymbol); string(b) != "et" {
+		t.Errorf("Symbol = %s, expected et", b)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserReplayArray(t *testing.T) {
+	p := parseFromRuby(t, `[]`)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	sub, err := p.Replay(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectToken(t, sub, rmarsh.TokenStartArray)
+	expectToken(t, sub, rmarsh.TokenEndArray)
+	expectToken(t, sub, rmarsh.TokenEOF)
+
+	// Replay Parsers can be reset to replay from the beginning again.
+	sub.Reset(nil)
+	expectToken(t, sub, rmarsh.TokenStartArray)
+	expectToken(t, sub, rmarsh.TokenEndArray)
+	expectToken(t, sub, rmarsh.TokenEOF)
+}
+
+func TestParserReplayHash(t *testing.T) {
+	p := parseFromRuby(t, `{:foo => :bar}`)
+	expectToken(t, p, rmarsh.TokenStartHash)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	sub, err := p.Replay(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectToken(t, sub, rmarsh.TokenStartHash)
+	b, _ := expectToken(t, sub, rmarsh.TokenSymbol)
+	if str := string(b); str != "foo" {
+		t.Errorf("Symbol = %s, expected foo", str)
+	}
+	b, _ = expectToken(t, sub, rmarsh.TokenSymbol)
+	if str := string(b); str != "bar" {
+		t.Errorf("Symbol = %s, expected bar", str)
+	}
+	expectToken(t, sub, rmarsh.TokenEndHash)
+	expectToken(t, sub, rmarsh.TokenEOF)
+}
+
+func TestParserReplayIVarString(t *testing.T) {
+	p := parseFromRuby(t, `"test"`)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	sub, err := p.Replay(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectToken(t, sub, rmarsh.TokenStartIVar)
+	expectToken(t, sub, rmarsh.TokenString)
+	expectToken(t, sub, rmarsh.TokenIVarProps)
+	expectToken(t, sub, rmarsh.TokenSymbol)
+	expectToken(t, sub, rmarsh.TokenTrue)
+	expectToken(t, sub, rmarsh.TokenEndIVar)
+	expectToken(t, sub, rmarsh.TokenEOF)
+}
+
+func TestParserReplayIVarSymbol(t *testing.T) {
+	// The non ASCII symbol is wrapped in an IVar for its encoding, but isn't in the link table.
+	p := parseFromRuby(t, `s = "x"; [:"f\u00f6\u00f6", s, s]`)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	expectToken(t, p, rmarsh.TokenString)
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	_, id := expectToken(t, p, rmarsh.TokenLink)
+	if id != 1 {
+		t.Errorf("Link id = %d, expected 1", id)
+	}
+
+	sub, err := p.Replay(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectToken(t, sub, rmarsh.TokenStartIVar)
+	if b, _ := expectToken(t, sub, rmarsh.TokenString); string(b) != "x" {
+		t.Errorf("String = %q, expected x", b)
+	}
+	expectToken(t, sub, rmarsh.TokenIVarProps)
+	expectToken(t, sub, rmarsh.TokenSymbol)
+	expectToken(t, sub, rmarsh.TokenTrue)
+	expectToken(t, sub, rmarsh.TokenEndIVar)
+	expectToken(t, sub, rmarsh.TokenEOF)
+}
+
+func TestParserReplayContrived(t *testing.T) {
+	p := parseFromRuby(t, `a = 1.2; b = [a, a]; [b, b]`)
+
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenFloat)
+	expectToken(t, p, rmarsh.TokenLink)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	_, id := expectToken(t, p, rmarsh.TokenLink)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	sub, err := p.Replay(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectToken(t, sub, rmarsh.TokenStartArray)
+	expectToken(t, sub, rmarsh.TokenFloat)
+	_, id = expectToken(t, sub, rmarsh.TokenLink)
+	expectToken(t, sub, rmarsh.TokenEndArray)
+	expectToken(t, sub, rmarsh.TokenEOF)
+
+	sub2, err := sub.Replay(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := expectToken(t, sub2, rmarsh.TokenFloat)
+	if str := string(b); str != "1.2" {
+		t.Errorf("Float = %s, expected 1.2", str)
+	}
+	expectToken(t, sub2, rmarsh.TokenEOF)
+}
+
+func TestParserReplayCyclic(t *testing.T) {
+	p := parseFromRuby(t, `a = []; a << a; a`)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	_, id := expectToken(t, p, rmarsh.TokenLink)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	sub, err := p.Replay(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectToken(t, sub, rmarsh.TokenStartArray)
+	_, id = expectToken(t, sub, rmarsh.TokenLink)
+	if _, err := sub.Replay(id); err == nil || err.Error() != "Object ID 0 is already being replayed by this Parser" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+}
+
+func TestParserUsrMarshal(t *testing.T) {
+	p := parseFromRuby(t, `Gem::Version.new('1.2.3')`)
+
+	expectToken(t, p, rmarsh.TokenUsrMarshal)
+	b, _ := expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "Gem::Version" {
+		t.Errorf("Symbol = %s, expected Gem::Version", str)
+	}
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	b, _ = expectToken(t, p, rmarsh.TokenString)
+	if str := string(b); str != "1.2.3" {
+		t.Errorf("String = %s, expected 1.2.3", str)
+	}
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserUsrDef(t *testing.T) {
+	p := parseFromRuby(t, `class UsrDef; def initialize(d); @d = d; end; def _dump(l); @d; end; end; UsrDef.new("test")`)
+
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	b, _ := expectToken(t, p, rmarsh.TokenUsrDef)
+	if str := string(b); str != "test" {
+		t.Errorf("UsrDef data = %s, expected test", str)
+	}
+	if name, err := p.ClassName(); err != nil {
+		t.Fatal(err)
+	} else if str := string(name); str != "UsrDef" {
+		t.Errorf("p.ClassName() = %s, expected UsrDef", str)
+	}
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserObject(t *testing.T) {
+	p := parseFromRuby(t, `Object.new.tap{|o| o.instance_variable_set(:@foo, 123); o.instance_variable_set(:@bar, nil)}`)
+
+	b, n := expectToken(t, p, rmarsh.TokenStartObject)
+	if str := string(b); str != "Object" {
+		t.Errorf("Object class = %s, expected Object", str)
+	}
+	if n != 2 {
+		t.Errorf("Object len = %d, expected 2", n)
+	}
+	b, _ = expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "@foo" {
+		t.Errorf("Symbol = %s, expected @foo", str)
+	}
+	expectToken(t, p, rmarsh.TokenFixnum)
+	b, _ = expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "@bar" {
+		t.Errorf("Symbol = %s, expected @bar", str)
+	}
+	expectToken(t, p, rmarsh.TokenNil)
+	expectToken(t, p, rmarsh.TokenEndObject)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserObjectEmpty(t *testing.T) {
+	p := parseFromRuby(t, `[Object.new, Object.new]`)
+
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartObject)
+	expectToken(t, p, rmarsh.TokenEndObject)
+	// Second object class name is a symlink.
+	b, _ := expectToken(t, p, rmarsh.TokenStartObject)
+	if str := string(b); str != "Object" {
+		t.Errorf("Object class = %s, expected Object", str)
+	}
+	expectToken(t, p, rmarsh.TokenEndObject)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserObjectInvalidKey(t *testing.T) {
+	raw := []byte{0x04, 0x08, 'o', ':', 0x06, 'A', 0x06, 'i', 0x06}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartObject)
+	if _, _, _, err := p.Read(); err == nil || err.Error() != "Expected Symbol, got TokenFixnum" {
+		t.Fatalf("Unexpected err %s", err)
+	}
+}
+
+func TestParserStruct(t *testing.T) {
+	p := parseFromRuby(t, `Struct.new("Test", :foo).new(123)`)
+
+	b, n := expectToken(t, p, rmarsh.TokenStartStruct)
+	if str := string(b); str != "Struct::Test" {
+		t.Errorf("Struct class = %s, expected Struct::Test", str)
+	}
+	if n != 1 {
+		t.Errorf("Struct len = %d, expected 1", n)
+	}
+	b, _ = expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "foo" {
+		t.Errorf("Symbol = %s, expected foo", str)
+	}
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndStruct)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserStructIVarMember(t *testing.T) {
+	// Ruby wraps non ASCII member names in an IVar to carry their encoding.
+	raw := []byte("\x04\x08S:\x08Foo\x06I:\x08\xe5\x90\x8d\x06:\x06ET0")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartStruct)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	b, _ := expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "\u540d" {
+		t.Errorf("Symbol = %s, expected \u540d", str)
+	}
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenNil)
+	expectToken(t, p, rmarsh.TokenEndStruct)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserObjectIVarKey(t *testing.T) {
+	raw := []byte("\x04\x08o:\x06A\x06I:\x09@\xe5\x90\x8d\x06:\x06ETi\x06")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartObject)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	b, _ := expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "@\u540d" {
+		t.Errorf("Symbol = %s, expected @\u540d", str)
+	}
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndObject)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserIVarClassNameUnsupported(t *testing.T) {
+	raw := []byte("\x04\x08oI:\x08\xe5\x90\x8d\x06:\x06ET\x00")
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	_, _, _, err := p.Read()
+	if err == nil || err.Error() != "IVar wrapped Symbol not supported as class or module name" {
+		t.Fatalf("Unexpected err %v", err)
+	}
+}
+
+func TestParserClass(t *testing.T) {
+	p := parseFromRuby(t, `[File, Process::Status]`)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	b, _ := expectToken(t, p, rmarsh.TokenClass)
+	if str := string(b); str != "File" {
+		t.Errorf("Class = %s, expected File", str)
+	}
+	b, _ = expectToken(t, p, rmarsh.TokenClass)
+	if str := string(b); str != "Process::Status" {
+		t.Errorf("Class = %s, expected Process::Status", str)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserModule(t *testing.T) {
+	p := parseFromRuby(t, `Process`)
+	b, _ := expectToken(t, p, rmarsh.TokenModule)
+	if str := string(b); str != "Process" {
+		t.Errorf("Module = %s, expected Process", str)
+	}
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserOldModule(t *testing.T) {
+	// Ruby no longer generates the legacy 'M' type, so we hand craft it.
+	raw := []byte{0x04, 0x08, '[', 0x07, 'M', 0x0C, 'P', 'r', 'o', 'c', 'e', 's', 's', '@', 0x06}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	b, _ := expectToken(t, p, rmarsh.TokenModule)
+	if str := string(b); str != "Process" {
+		t.Errorf("Module = %s, expected Process", str)
+	}
+	// Module is a linkable object.
+	_, id := expectToken(t, p, rmarsh.TokenLink)
+	if id != 1 {
+		t.Errorf("Link id = %d, expected 1", id)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserRegexp(t *testing.T) {
+	p := parseFromRuby(t, `/test/ix`)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	b, flags := expectToken(t, p, rmarsh.TokenRegexp)
+	if str := string(b); str != "test" {
+		t.Errorf("Regexp = %s, expected test", str)
+	}
+	if flags != rmarsh.RegexpIgnoreCase|rmarsh.RegexpExtended {
+		t.Errorf("Regexp flags = %#x, expected %#x", flags, rmarsh.RegexpIgnoreCase|rmarsh.RegexpExtended)
+	}
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	b, _ = expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "E" {
+		t.Errorf("Symbol = %s, expected E", str)
+	}
+	expectToken(t, p, rmarsh.TokenFalse)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserRegexpUTF8(t *testing.T) {
+	p := parseFromRuby(t, `/tëst/m`)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	b, flags := expectToken(t, p, rmarsh.TokenRegexp)
+	if str := string(b); str != "tëst" {
+		t.Errorf("Regexp = %s, expected tëst", str)
+	}
+	if flags&rmarsh.RegexpMultiline == 0 || flags&rmarsh.RegexpFixedEncoding == 0 {
+		t.Errorf("Regexp flags = %#x, expected multiline and fixed encoding", flags)
+	}
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserExtended(t *testing.T) {
+	p := parseFromRuby(t, `Object.new.extend(Comparable)`)
+	b, _ := expectToken(t, p, rmarsh.TokenExtended)
+	if str := string(b); str != "Comparable" {
+		t.Errorf("Extended module = %s, expected Comparable", str)
+	}
+	b, _ = expectToken(t, p, rmarsh.TokenStartObject)
+	if str := string(b); str != "Object" {
+		t.Errorf("Object class = %s, expected Object", str)
+	}
+	expectToken(t, p, rmarsh.TokenEndObject)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserUsrClass(t *testing.T) {
+	p := parseFromRuby(t, `class UsrClassArray < Array; end; [UsrClassArray.new([1]), :foo]`)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	b, _ := expectToken(t, p, rmarsh.TokenUsrClass)
+	if str := string(b); str != "UsrClassArray" {
+		t.Errorf("User class = %s, expected UsrClassArray", str)
+	}
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserUsrClassIVar(t *testing.T) {
+	p := parseFromRuby(t, `class UsrClassString < String; end; UsrClassString.new("test")`)
+	expectToken(t, p, rmarsh.TokenStartIVar)
+	b, _ := expectToken(t, p, rmarsh.TokenUsrClass)
+	if str := string(b); str != "UsrClassString" {
+		t.Errorf("User class = %s, expected UsrClassString", str)
+	}
+	b, _ = expectToken(t, p, rmarsh.TokenString)
+	if str := string(b); str != "test" {
+		t.Errorf("String = %s, expected test", str)
+	}
+	expectToken(t, p, rmarsh.TokenIVarProps)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndIVar)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserHashWithDefault(t *testing.T) {
+	p := parseFromRuby(t, `Hash.new(0).tap{|h| h[:foo] = 123}`)
+	_, n := expectToken(t, p, rmarsh.TokenStartHash)
+	if n != 1 {
+		t.Errorf("Hash len = %d, expected 1", n)
+	}
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenHashDefault)
+	_, n = expectToken(t, p, rmarsh.TokenFixnum)
+	if n != 0 {
+		t.Errorf("Hash default = %d, expected 0", n)
+	}
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p = parseFromRuby(t, `Hash.new([])`)
+	expectToken(t, p, rmarsh.TokenStartHash)
+	expectToken(t, p, rmarsh.TokenHashDefault)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserData(t *testing.T) {
+	// Ruby can only dump typed data from classes implemented in C, so we hand craft it.
+	raw := []byte{0x04, 0x08, '[', 0x07, 'd', ':', 0x09, 'D', 'a', 't', 'a', '[', 0x06, 'i', 0x06, '@', 0x06}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenData)
+	b, _ := expectToken(t, p, rmarsh.TokenSymbol)
+	if str := string(b); str != "Data" {
+		t.Errorf("Symbol = %s, expected Data", str)
+	}
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	_, id := expectToken(t, p, rmarsh.TokenLink)
+	if id != 1 {
+		t.Errorf("Link id = %d, expected 1", id)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	sub, err := p.Replay(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectToken(t, sub, rmarsh.TokenData)
+	expectToken(t, sub, rmarsh.TokenSymbol)
+	expectToken(t, sub, rmarsh.TokenStartArray)
+	expectToken(t, sub, rmarsh.TokenFixnum)
+	expectToken(t, sub, rmarsh.TokenEndArray)
+	expectToken(t, sub, rmarsh.TokenEOF)
+}
@@ -7,7 +7,9 @@ class Hash
       return "IVarTest<#{@ivartest.inspect}>"
     end
 
-    "{#{keys.sort.map{|k|k.inspect+'=>'+self[k].inspect}.join(', ')}}"
+    str = "{#{keys.sort.map{|k|k.inspect+'=>'+self[k].inspect}.join(', ')}}"
+    str += "<default=#{default.inspect}>" unless default.nil?
+    str
   end
 end
 class Object
@@ -45,6 +47,17 @@ class UsrDef
   end
 end
 
+module TestExtended
+  def inspect
+    "TestExtended<#{super}>"
+  end
+end
+class UsrClassArray < Array
+  def inspect
+    "UsrClassArray<#{super}>"
+  end
+end
+
 TestStruct = Struct.new(:test) do
   def inspect
     "TestStruct<#{test.inspect}>"
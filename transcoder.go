@@ -0,0 +1,80 @@
+package rmarsh
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// A Transcoder converts text in a Ruby encoding to UTF-8.
+type Transcoder interface {
+	// Transcode returns the UTF-8 representation of src, which is encoded in the Ruby encoding named enc.
+	// An InvalidEncodingError is returned if src is not valid in that encoding.
+	Transcode(src []byte, enc string) ([]byte, error)
+}
+
+// InvalidEncodingError is the error returned by a Transcoder when text contains byte sequences that are not valid in
+// its declared encoding.
+type InvalidEncodingError struct {
+	Encoding string
+}
+
+func (e InvalidEncodingError) Error() string {
+	return fmt.Sprintf("Invalid byte sequence in %s", e.Encoding)
+}
+
+// TextTranscoder is a Transcoder backed by golang.org/x/text encodings, keyed by Ruby encoding name.
+type TextTranscoder map[string]encoding.Encoding
+
+// Transcode implements the Transcoder interface.
+func (t TextTranscoder) Transcode(src []byte, enc string) ([]byte, error) {
+	e, ok := t[enc]
+	if !ok {
+		return nil, errors.Errorf("Unsupported encoding %s", enc)
+	}
+
+	b, err := e.NewDecoder().Bytes(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// The decoders substitute U+FFFD for invalid byte sequences. The source text may legitimately contain U+FFFD
+	// though, so it's only invalid if there are more of them in the decoded text than in the source.
+	if n := bytes.Count(b, replacementChar); n > 0 {
+		rep, err := e.NewEncoder().Bytes(replacementChar)
+		if err != nil || n > bytes.Count(src, rep) {
+			return nil, InvalidEncodingError{enc}
+		}
+	}
+	return b, nil
+}
+
+var replacementChar = []byte(string(utf8.RuneError))
+
+// DefaultTranscoder supports the common legacy encodings that Ruby strings are found in.
+var DefaultTranscoder = TextTranscoder{
+	"Shift_JIS":    japanese.ShiftJIS,
+	"Windows-31J":  japanese.ShiftJIS,
+	"EUC-JP":       japanese.EUCJP,
+	"ISO-2022-JP":  japanese.ISO2022JP,
+	"EUC-KR":       korean.EUCKR,
+	"GBK":          simplifiedchinese.GBK,
+	"Big5":         traditionalchinese.Big5,
+	"ISO-8859-1":   charmap.ISO8859_1,
+	"ISO-8859-2":   charmap.ISO8859_2,
+	"ISO-8859-5":   charmap.ISO8859_5,
+	"ISO-8859-15":  charmap.ISO8859_15,
+	"Windows-1250": charmap.Windows1250,
+	"Windows-1251": charmap.Windows1251,
+	"Windows-1252": charmap.Windows1252,
+	"KOI8-R":       charmap.KOI8R,
+	"IBM437":       charmap.CodePage437,
+}